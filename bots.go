@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How many messages can be waiting for the bots before new ones are dropped.
+const BOT_QUEUE = 100
+
+// MessageHandler is a bot that sees every chat message and emote. Handlers
+// are called one message at a time, away from the broadcast, so a slow bot
+// only delays other bots. They may reply through the Server, for example with
+// Broadcast, or to the sender with SysMsg.
+type MessageHandler interface {
+	OnMessage(sender *Client, text string)
+}
+
+// Bots are the handlers that can be enabled by name with --bot.
+var Bots = map[string]func(*Server) MessageHandler{
+	"echo": NewEchoBot,
+}
+
+type botMessage struct {
+	sender *Client
+	text   string
+}
+
+// AddHandler registers h to be called for each chat message and emote.
+func (s *Server) AddHandler(h MessageHandler) {
+	s.botLock.Lock()
+	defer s.botLock.Unlock()
+
+	if s.botQueue == nil {
+		s.botQueue = make(chan botMessage, BOT_QUEUE)
+		go s.runHandlers()
+	}
+	s.handlers = append(s.handlers, h)
+}
+
+// notifyHandlers queues m for the bots, dropping it if they're behind.
+func (s *Server) notifyHandlers(m *Message) {
+	if m.From == nil {
+		return
+	}
+	s.botLock.RLock()
+	queue := s.botQueue
+	s.botLock.RUnlock()
+	if queue == nil {
+		return
+	}
+	select {
+	case queue <- botMessage{sender: m.From, text: strings.TrimPrefix(m.Body, " ")}:
+	default:
+		logger.Debugf("Dropped message for bots, queue is full")
+	}
+}
+
+func (s *Server) runHandlers() {
+	for {
+		select {
+		case msg := <-s.botQueue:
+			s.botLock.RLock()
+			handlers := s.handlers
+			s.botLock.RUnlock()
+			for _, h := range handlers {
+				callHandler(h, msg)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// callHandler calls h, so that a bot that panics doesn't take the server down.
+func callHandler(h MessageHandler, msg botMessage) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Errorf("Bot %T failed: %v", h, err)
+		}
+	}()
+	h.OnMessage(msg.sender, msg.text)
+}
+
+// EchoBot repeats messages starting with "!echo " back to the room.
+type EchoBot struct {
+	server *Server
+}
+
+func NewEchoBot(server *Server) MessageHandler {
+	return &EchoBot{server: server}
+}
+
+func (b *EchoBot) OnMessage(sender *Client, text string) {
+	if !strings.HasPrefix(text, "!echo ") {
+		return
+	}
+	b.server.Broadcast(fmt.Sprintf("* echo: %s", strings.TrimPrefix(text, "!echo ")), nil)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type panicBot struct{}
+
+func (panicBot) OnMessage(sender *Client, text string) { panic("oops") }
+
+func TestEchoBot(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+	server.AddHandler(panicBot{})
+	server.AddHandler(NewEchoBot(server))
+	sender := newTestClient(server, "sender")
+
+	server.BroadcastMessage(NewChatMsg(sender, "no echo"), sender)
+	server.BroadcastMessage(NewChatMsg(sender, "!echo hi there"), sender)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		select {
+		case line := <-sender.Msg:
+			if strings.Contains(line, "no echo") {
+				t.Fatalf("Bot echoed a message without !echo: %q", line)
+			}
+			if strings.Contains(line, "echo: hi there") {
+				return
+			}
+		case <-time.After(time.Until(deadline)):
+			t.Fatal("Bot didn't reply.")
+		}
+	}
+}
+
+func TestResponder(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+	responder := NewResponder(server)
+	responder.SetRules([]ResponderRule{
+		{Match: "^!rules$", Reply: "* Be nice."},
+		{Match: "^!faq", Reply: "Read the FAQ.", Private: true},
+	})
+	sender := newTestClient(server, "sender")
+	other := newTestClient(server, "other")
+
+	responder.OnMessage(sender, "!rules")
+	responder.OnMessage(sender, "!rules") // Rate limited.
+	responder.OnMessage(sender, "!faq please")
+
+	if line := <-other.Msg; !strings.Contains(line, "Be nice.") {
+		t.Errorf("Got %q, expected the rules", line)
+	}
+	if line := <-sender.Msg; !strings.Contains(line, "Be nice.") {
+		t.Errorf("Got %q, expected the rules", line)
+	}
+	if line := <-sender.Msg; !strings.Contains(line, "Read the FAQ.") {
+		t.Errorf("Got %q, expected the FAQ reply", line)
+	}
+	select {
+	case line := <-other.Msg:
+		t.Errorf("Got %q, expected nothing more", line)
+	default:
+	}
+
+	// Reloading keeps the rate limits of rules that didn't change.
+	responder.SetRules([]ResponderRule{
+		{Match: "^!rules$", Reply: "* Be nice."},
+		{Match: "^!new$", Reply: "New rule."},
+	})
+	responder.OnMessage(sender, "!rules")
+	responder.OnMessage(sender, "!new")
+	if line := <-other.Msg; !strings.Contains(line, "New rule.") {
+		t.Errorf("Got %q, expected only the new rule", line)
+	}
+}
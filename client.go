@@ -1,24 +1,71 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"math"
+	"net"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
+// RE_ESCAPE matches terminal escape sequences: CSI sequences like colors and
+// cursor movement, OSC sequences like title changes, and two-byte escapes.
+var RE_ESCAPE = regexp.MustCompile(`\x1b(\[[0-9;?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)?|[@-~])`)
+
 const MSG_BUFFER int = 10
 
-const HELP_TEXT string = `-> Available commands:
-   /about
-   /exit
-   /help
-   /list
-   /nick $NAME
-   /whois $NAME
-`
+// How many of their own chat lines are kept for each client, for /again.
+const SENT_HISTORY int = 20
+const SEARCH_MAX_RESULTS int = 10
+
+// The terminal keeps this many characters of a line and ignores the rest of
+// it, so a long line costs no more memory than that. A line that reaches it
+// may have been cut short, so it's dropped rather than parsed. It's well above
+// what a message may be.
+const MAX_LINE_LENGTH int = 4096
+
+// How many environment variables, and how long a name and value, are kept
+// from a client's env requests.
+const MAX_ENV int = 32
+const MAX_ENV_LENGTH int = 256
+
+// CHAT_NAME_ENV is the environment variable a client can send to join under
+// a name other than its SSH username.
+const CHAT_NAME_ENV = "CHATNAME"
+
+// CHAT_QUIET_ENV is the environment variable a client can send to join
+// without the history, MOTD, and pinned message being replayed.
+const CHAT_QUIET_ENV = "CHATQUIET"
+
+// Terminal size assumed until the client reports a usable one.
+const DEFAULT_WIDTH int = 80
+const DEFAULT_HEIGHT int = 24
+
+// Terminal dimensions past this are clamped, rather than passed on as sent.
+const MAX_TERM_SIZE int = 1000
+
+// Failed resizes are logged at most this often per client.
+const RESIZE_LOG_INTERVAL = time.Minute
+
+// Failed writes in a row after which a client's connection is dropped.
+const MAX_WRITE_FAILURES int32 = 3
+
+// MORE_PROMPT is shown between screens of long command output.
+const MORE_PROMPT = "-- more -- "
+
+// Chat lines up to this many characters can be held back and sent together
+// when the server coalesces short messages.
+const COALESCE_LENGTH int = 3
 
 const ABOUT_TEXT string = `-> ssh-chat is made by @shazow.
 
@@ -30,71 +77,743 @@ const ABOUT_TEXT string = `-> ssh-chat is made by @shazow.
    For more, visit shazow.net or follow at twitter.com/shazow
 `
 
+// Terminal is what a client's lines are read from and written to. SSH and
+// telnet sessions get a full terminal, other transports something simpler.
+type Terminal interface {
+	io.Writer
+	ReadLine() (string, error)
+	SetPrompt(prompt string)
+	SetSize(width int, height int) error
+}
+
+// Conn is the connection a client talks over. SSH connections are wrapped in
+// an sshClientConn, while telnet, WebSockets, and tests bring their own, so
+// that a Client doesn't need a real SSH connection.
+//
+// This is where the Server is decoupled from SSH for testing, rather than
+// behind an interface for the Client itself: the Server relies on much more
+// of a Client than writing to it, like its theme, rate limits, and away
+// status, and those are the same whatever it's connected over. Tests make a
+// real Client with a fake Conn, and a fake Terminal to see what it's sent.
+type Conn interface {
+	User() string
+	Fingerprint() string // empty without a key
+	RemoteAddr() net.Addr
+	ClientVersion() []byte
+	Close() error
+	Wait() error
+}
+
+// sshClientConn is the Conn for an SSH connection, authenticated by key.
+type sshClientConn struct {
+	*ssh.ServerConn
+}
+
+func (c sshClientConn) Fingerprint() string {
+	return c.Permissions.Extensions["fingerprint"]
+}
+
+// Keepalive sends a request OpenSSH clients answer but don't show.
+func (c sshClientConn) Keepalive() error {
+	_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+	return err
+}
+
+// keepaliveConn is a Conn that can send something the client won't show, so
+// that proxies and NATs don't drop a quiet connection.
+type keepaliveConn interface {
+	Keepalive() error
+}
+
 type Client struct {
 	Server        *Server
-	Conn          *ssh.ServerConn
+	Conn          Conn
 	Msg           chan string
 	Name          string
 	Op            bool
 	ready         chan struct{}
-	term          *terminal.Terminal
+	term          Terminal
 	termWidth     int
 	termHeight    int
+	termSized     bool // the client reported its size, so output can be paged
+	resizeFails   int  // resizes the terminal refused this session
 	silencedUntil time.Time
+	quiet         bool
+	theme         *Theme
+	compact       bool
+	away          string // reason, empty unless away
+	autoAway      bool   // away because of being idle, until the next line
+	guest         bool   // connected over telnet, without a key
+	connected     time.Time
+	lastActive    time.Time
+	lastSent      time.Time // when the client's last message was broadcast
+	renameCount   int       // name changes this session
+	lastMsg       string    // the client's last chat message, for /edit
+	lastMsgAt     time.Time
+	sent          []string // the client's recent chat lines, oldest first
+	hasShell      bool     // a session channel started the shell, only one may
+
+	// noticesMutedUntil is when room notices are shown again after
+	// /mutenotices.
+	noticesMutedUntil time.Time
+
+	// stateLock guards silencedUntil, quiet, theme, compact, away,
+	// autoAway, lastActive, and noticesMutedUntil, which other goroutines
+	// use while the client's own does: the idle check marks it away, ops
+	// silence it, and broadcasts check its settings and whether it muted
+	// notices.
+	stateLock sync.Mutex
+
+	// writeFails counts the writes in a row that failed. It's updated
+	// atomically, as clients are written to from more than one goroutine.
+	writeFails int32
+
+	// skipped counts the lines dropped because Msg was full, until the
+	// client is told about them. It's updated atomically.
+	skipped int32
+
+	// pending holds short lines waiting to be sent as one, until
+	// pendingTimer goes off. lineLock is held while a line is handled, so
+	// that the timer doesn't send them in the middle of another.
+	pending      []string
+	pendingTimer *time.Timer
+	lineLock     sync.Mutex
+
+	// identity is the Identity of a client without a key.
+	identity string
+
+	// env is from the client's env requests, sent before the shell starts.
+	env map[string]string
+
+	msgLimiter   *RateLimiter
+	nickLimiter  *RateLimiter
+	queryLimiter *RateLimiter
+	resizeLog    *RateLimiter
+	cooldowns    map[string]*RateLimiter // by command name, made on first use
+
+	// ctx is cancelled when the client is removed from the server, which
+	// stops all of its goroutines.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewClient(server *Server, conn *ssh.ServerConn) *Client {
+func NewClient(server *Server, conn Conn) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	now := server.Clock()
 	return &Client{
 		Server: server,
 		Conn:   conn,
 		Name:   conn.User(),
 		Msg:    make(chan string, MSG_BUFFER),
 		ready:  make(chan struct{}, 1),
+		theme:  DefaultTheme,
+		ctx:    ctx,
+		cancel: cancel,
+
+		connected:  now,
+		lastActive: now,
+
+		identity: "addr:" + hostOf(conn.RemoteAddr()) + "/" + conn.User(),
+
+		termWidth:    DEFAULT_WIDTH,
+		termHeight:   DEFAULT_HEIGHT,
+		msgLimiter:   server.newRateLimiter(server.MessageInterval, server.MessageBurst),
+		nickLimiter:  server.newRateLimiter(server.NickInterval, server.NickBurst),
+		queryLimiter: server.newRateLimiter(server.QueryInterval, server.QueryBurst),
+		resizeLog:    server.newRateLimiter(RESIZE_LOG_INTERVAL, 1),
+		cooldowns:    map[string]*RateLimiter{},
+	}
+}
+
+// Write writes msg to the client's terminal right away, as a line. Clients
+// without a UTF-8 locale get wide and zero width characters replaced, as
+// their terminal may not give them the width we expect. After
+// MAX_WRITE_FAILURES failed writes in a row the connection is taken to be
+// broken, and the client is removed and disconnected.
+func (c *Client) Write(msg string) error {
+	if !c.UTF8() {
+		msg = toNarrow(msg)
 	}
+	_, err := c.term.Write([]byte(msg + "\r\n"))
+	if err == nil {
+		atomic.StoreInt32(&c.writeFails, 0)
+		return nil
+	}
+	if atomic.AddInt32(&c.writeFails, 1) == MAX_WRITE_FAILURES {
+		logger.Infof("Disconnecting %s after %d failed writes: %v", c.Name, MAX_WRITE_FAILURES, err)
+		c.Server.Remove(c)
+		c.Conn.Close()
+	}
+	return err
+}
+
+// SysMsg queues a system reply for the client, formatted as with fmt.Sprintf.
+// It's often sent on another client's behalf, like an op's, so it doesn't
+// wait for room in a full buffer.
+func (c *Client) SysMsg(format string, args ...interface{}) {
+	c.deliver(c.sysLine(format, args...))
 }
 
-func (c *Client) Write(msg string) {
-	c.term.Write([]byte(msg + "\r\n"))
+// deliver queues line for the client without blocking. It reports false if
+// the buffer is full or the client has been removed, in which case nothing
+// is reading Msg any more. Lines dropped because the buffer is full are
+// counted, so the client can be told once it catches up.
+func (c *Client) deliver(line string) bool {
+	select {
+	case <-c.ctx.Done():
+		return false
+	default:
+	}
+	select {
+	case c.Msg <- line:
+		return true
+	default:
+		atomic.AddInt32(&c.skipped, 1)
+		return false
+	}
 }
 
-func (c *Client) WriteLines(msg []string) {
+// writeQueued writes line from Msg to the client. Once it has caught up on
+// Msg, it's told how many lines were skipped while it was behind, if any.
+func (c *Client) writeQueued(line string) {
+	c.Write(line)
+	if len(c.Msg) > 0 {
+		return
+	}
+	if n := atomic.SwapInt32(&c.skipped, 0); n > 0 {
+		c.Write(c.sysLine("%s", c.Server.Text("messages_skipped", n)))
+	}
+}
+
+// Warn queues a warning from the ops for the client, set apart from other
+// system messages.
+func (c *Client) Warn(text string) {
+	c.deliver(c.Theme().ColorHighlight("[SERVER WARNING] " + text))
+}
+
+// SysWrite is like SysMsg but writes immediately rather than queueing.
+func (c *Client) SysWrite(format string, args ...interface{}) error {
+	return c.Write(c.sysLine(format, args...))
+}
+
+func (c *Client) sysLine(format string, args ...interface{}) string {
+	prefix := "-> "
+	if c.Compact() {
+		prefix = "> "
+	}
+	return c.Theme().ColorSystem(prefix + fmt.Sprintf(format, args...))
+}
+
+// WriteLines writes each line, skipping blank ones in compact mode. It stops
+// at the first write that fails.
+func (c *Client) WriteLines(msg []string) error {
+	compact := c.Compact()
 	for _, line := range msg {
-		c.Write(line)
+		if compact && strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err := c.Write(line); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func (c *Client) IsSilenced() bool {
-	return c.silencedUntil.After(time.Now())
+	return c.SilenceRemaining() > 0
+}
+
+// SilenceRemaining returns how much longer the client is silenced for.
+func (c *Client) SilenceRemaining() time.Duration {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.silencedUntil.Sub(c.Server.Clock())
+}
+
+// Silence silences the client for d, and returns when it ends.
+func (c *Client) Silence(d time.Duration) time.Time {
+	until := c.Server.Clock().Add(d)
+	c.silenceUntil(until)
+	return until
+}
+
+func (c *Client) silenceUntil(until time.Time) {
+	c.stateLock.Lock()
+	c.silencedUntil = until
+	c.stateLock.Unlock()
+}
+
+// NoticesMuted reports whether the client has muted room notices for now.
+func (c *Client) NoticesMuted() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.noticesMutedUntil.After(c.Server.Clock())
+}
+
+// MuteNotices hides room notices from the client until then. The zero time
+// shows them again.
+func (c *Client) MuteNotices(until time.Time) {
+	c.stateLock.Lock()
+	c.noticesMutedUntil = until
+	c.stateLock.Unlock()
+}
+
+// Theme returns the theme the client's messages are rendered with.
+func (c *Client) Theme() *Theme {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.theme
+}
+
+func (c *Client) SetTheme(theme *Theme) {
+	c.stateLock.Lock()
+	c.theme = theme
+	c.stateLock.Unlock()
+}
+
+// Compact reports whether the client turned on compact mode, which leaves out
+// blank lines and shortens the system message prefix.
+func (c *Client) Compact() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.compact
+}
+
+func (c *Client) SetCompact(compact bool) {
+	c.stateLock.Lock()
+	c.compact = compact
+	c.stateLock.Unlock()
+}
+
+// PresenceHidden reports whether the client hid join and leave notices with
+// /quiet.
+func (c *Client) PresenceHidden() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.quiet
+}
+
+func (c *Client) HidePresence(hide bool) {
+	c.stateLock.Lock()
+	c.quiet = hide
+	c.stateLock.Unlock()
+}
+
+func (c *Client) IsAway() bool {
+	return c.AwayReason() != ""
+}
+
+// AwayReason returns why the client is away, or "" if it isn't.
+func (c *Client) AwayReason() string {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.away
+}
+
+// setAway marks the client away for reason, until it's back.
+func (c *Client) setAway(reason string) {
+	c.stateLock.Lock()
+	c.away = reason
+	c.autoAway = false
+	c.stateLock.Unlock()
+	c.tell("away", reason)
+}
+
+// goIdle marks the client away for being idle, unless it's already away, and
+// reports whether it did.
+func (c *Client) goIdle() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if c.away != "" {
+		return false
+	}
+	c.away = "idle"
+	c.autoAway = true
+	return true
+}
+
+// Back clears the away status and delivers the mentions missed meanwhile.
+func (c *Client) Back() {
+	c.stateLock.Lock()
+	c.away = ""
+	c.autoAway = false
+	c.stateLock.Unlock()
+	c.tell("back")
+	c.sendMentions()
+}
+
+// sendMentions queues the mentions kept for the client since it was last
+// shown them.
+func (c *Client) sendMentions() bool {
+	entries := c.Server.mentions.Take(c.Identity())
+	if len(entries) == 0 {
+		return false
+	}
+	c.SysMsg("%s", c.Server.missedMentions(len(entries)))
+	for _, entry := range entries {
+		c.deliver(entry.String())
+	}
+	return true
 }
 
-func (c *Client) Silence(d time.Duration) {
-	c.silencedUntil = time.Now().Add(d)
+// missedMentions introduces the n mentions a client missed while away.
+func (s *Server) missedMentions(n int) string {
+	if n == 1 {
+		return s.Text("missed_mention")
+	}
+	return s.Text("missed_mentions", n)
 }
 
+// Resize sets the terminal size. Clients that report a zero dimension get
+// the default size instead, and huge ones are clamped to MAX_TERM_SIZE, so
+// termWidth and termHeight are always usable. If the terminal refuses the
+// size, the last one that worked is kept and the session carries on.
 func (c *Client) Resize(width int, height int) error {
+	sized := width > 0 && height > 0
+	if !sized {
+		logger.Debugf("Got a %dx%d terminal size, using %dx%d", width, height, DEFAULT_WIDTH, DEFAULT_HEIGHT)
+		width, height = DEFAULT_WIDTH, DEFAULT_HEIGHT
+	}
+	if width > MAX_TERM_SIZE || height > MAX_TERM_SIZE {
+		logger.Debugf("Got a %dx%d terminal size, clamping to %d", width, height, MAX_TERM_SIZE)
+		width, height = clampSize(width), clampSize(height)
+	}
 	err := c.term.SetSize(width, height)
 	if err != nil {
-		logger.Errorf("Resize failed: %dx%d", width, height)
+		// Clients that send bad sizes tend to keep sending them, so
+		// don't log every one.
+		c.resizeFails++
+		if c.resizeLog.Allow() {
+			logger.Errorf("Resize failed for %s: %dx%d: %v (%d so far)", c.Name, width, height, err, c.resizeFails)
+		}
 		return err
 	}
 	c.termWidth, c.termHeight = width, height
+	c.termSized = sized
 	return nil
 }
 
+// Page writes lines like WriteLines, but a screen at a time when there are
+// more than fit, waiting for Enter before each next screen. Anything else
+// typed at the MORE_PROMPT stops it. Without a reported terminal size,
+// everything is written at once. Page reads from the terminal, so it must
+// only be called from the shell loop, as command handlers are.
+func (c *Client) Page(lines []string) {
+	if c.Compact() {
+		kept := []string{}
+		for _, line := range lines {
+			if strings.TrimSpace(line) != "" {
+				kept = append(kept, line)
+			}
+		}
+		lines = kept
+	}
+	// Leave a line for the prompt.
+	height := c.termHeight - 1
+	if !c.termSized || height < 1 {
+		c.WriteLines(lines)
+		return
+	}
+	for len(lines) > height {
+		c.WriteLines(lines[:height])
+		lines = lines[height:]
+		if !c.more() {
+			c.SysWrite("%s", c.Server.Text("more_lines", len(lines)))
+			return
+		}
+	}
+	c.WriteLines(lines)
+}
+
+// more shows the MORE_PROMPT and reports whether the client wants more.
+func (c *Client) more() bool {
+	c.term.SetPrompt(MORE_PROMPT)
+	line, err := c.term.ReadLine()
+	c.term.SetPrompt(c.prompt())
+	return err == nil && strings.TrimSpace(line) == ""
+}
+
+func clampSize(n int) int {
+	if n > MAX_TERM_SIZE {
+		return MAX_TERM_SIZE
+	}
+	return n
+}
+
+// Env returns the value of an environment variable the client sent, or an
+// empty string. TERM is also taken from the pty request.
+func (c *Client) Env(name string) string {
+	return c.env[name]
+}
+
+// Quiet reports whether the client asked to join without the replay, by
+// sending CHAT_QUIET_ENV as anything but "0".
+func (c *Client) Quiet() bool {
+	quiet := c.Env(CHAT_QUIET_ENV)
+	return quiet != "" && quiet != "0"
+}
+
+// UTF8 reports whether the client's locale is UTF-8, going by LC_ALL,
+// LC_CTYPE, and LANG in that order. Clients that don't say are assumed to be.
+func (c *Client) UTF8() bool {
+	for _, name := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		locale := c.Env(name)
+		if locale == "" {
+			continue
+		}
+		locale = strings.ToLower(locale)
+		return strings.Contains(locale, "utf-8") || strings.Contains(locale, "utf8")
+	}
+	return true
+}
+
+// setEnv records an environment variable from the client's session, and uses
+// it as the default for a preference where there is one: color is off for
+// dumb terminals and when NO_COLOR is set. It returns false if the variable
+// is too long or there are already too many.
+func (c *Client) setEnv(name string, value string) bool {
+	if len(name)+len(value) > MAX_ENV_LENGTH {
+		return false
+	}
+	if _, ok := c.env[name]; !ok && len(c.env) >= MAX_ENV {
+		return false
+	}
+	if c.env == nil {
+		c.env = map[string]string{}
+	}
+	c.env[name] = value
+
+	switch name {
+	case "TERM":
+		if value == "dumb" {
+			c.SetTheme(MonochromeTheme)
+		}
+	case "NO_COLOR":
+		if value != "" {
+			c.SetTheme(MonochromeTheme)
+		}
+	case CHAT_NAME_ENV:
+		// Cleaned as the SSH username would be. A name with nothing
+		// left after cleaning keeps the username instead.
+		if name := c.Server.cleanName(value); name != "" {
+			c.Name = name
+		}
+	}
+	return true
+}
+
+// Rename changes the client's name and prompt.
 func (c *Client) Rename(name string) {
 	c.Name = name
-	c.term.SetPrompt(fmt.Sprintf("[%s] ", name))
+	c.showPrompt()
+}
+
+// showPrompt sets the prompt for the client's name. The terminal only redraws
+// the prompt when something is written, so an empty write follows to show the
+// new one right away, along with whatever was being typed. That write can
+// block on a client that stopped reading, so the server's lock mustn't be held.
+func (c *Client) showPrompt() {
+	c.term.SetPrompt(c.prompt())
+	c.term.Write(nil)
+}
+
+// prompt is what the client types after, its name and maybe the room's.
+func (c *Client) prompt() string {
+	if c.Server.RoomPrompt {
+		return fmt.Sprintf("[%s] [%s] ", c.Server.RoomName, c.Name)
+	}
+	return fmt.Sprintf("[%s] ", c.Name)
 }
 
 func (c *Client) Fingerprint() string {
-	return c.Conn.Permissions.Extensions["fingerprint"]
+	return c.Conn.Fingerprint()
+}
+
+// Identity is what per-user state is kept by. It's the fingerprint of the
+// client's key or, for clients without one, their address and the name they
+// connected with, so that such clients aren't all taken for the same user.
+//
+// Colors, mentions kept while away, silences, and holding back the leave of
+// a dropped connection go by identity. An address is no proof of who someone
+// is, so ops, bans, badges, and taking over a lingering session need a key.
+func (c *Client) Identity() string {
+	if fingerprint := c.Fingerprint(); fingerprint != "" {
+		return fingerprint
+	}
+	return c.identity
+}
+
+// RemoteIP returns the address the client connected from, without the port.
+func (c *Client) RemoteIP() string {
+	return hostOf(c.Conn.RemoteAddr())
+}
+
+// Version returns the version string the client identified itself with,
+// sanitized for display. The client controls it entirely, so escape
+// sequences are dropped and other control characters replaced.
+func (c *Client) Version() string {
+	return printable(RE_ESCAPE.ReplaceAllString(string(c.Conn.ClientVersion()), ""))
+}
+
+// Software returns the client's software and its version, like "OpenSSH 9.6"
+// for "SSH-2.0-OpenSSH_9.6", or the whole Version if it isn't in that form.
+func (c *Client) Software() string {
+	return softwareName(c.Version())
+}
+
+// softwareName parses the software out of an SSH version string, which is
+// "SSH-protoversion-softwareversion comments". By convention the software is
+// separated from its version by underscores.
+func softwareName(version string) string {
+	parts := strings.SplitN(version, "-", 3)
+	if len(parts) != 3 || parts[0] != "SSH" {
+		return version
+	}
+	software := strings.Fields(parts[2])
+	if len(software) == 0 {
+		return version
+	}
+	return strings.TrimSpace(strings.Replace(software[0], "_", " ", -1))
+}
+
+// Idle returns how long it's been since the client last sent a line.
+func (c *Client) Idle() time.Duration {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.Server.Clock().Sub(c.lastActive)
+}
+
+// touch records that the client just sent a line, and reports whether it
+// had been marked away for being idle.
+func (c *Client) touch() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.lastActive = c.Server.Clock()
+	return c.autoAway
+}
+
+// printable replaces control characters and invalid UTF-8 in s, so that text
+// from a client can't move the cursor or recolor another user's terminal.
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// toNarrow replaces the characters in s that a terminal without a UTF-8
+// locale can't be trusted to give the width we expect with "?": wide ones
+// like emoji and CJK, and zero width ones like combining marks and joiners.
+// Accented letters and other single width text are left alone.
+func toNarrow(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII && (isWide(r) || unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf)) {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// wideRanges are the characters that take two columns on a terminal: the
+// East Asian wide and fullwidth ranges, and emoji.
+var wideRanges = [][2]rune{
+	{0x1100, 0x115F},   // Hangul Jamo
+	{0x2E80, 0xA4CF},   // CJK, Kana, and Yi
+	{0xAC00, 0xD7A3},   // Hangul syllables
+	{0xF900, 0xFAFF},   // CJK compatibility ideographs
+	{0xFE30, 0xFE4F},   // CJK compatibility forms
+	{0xFF00, 0xFF60},   // Fullwidth forms
+	{0xFFE0, 0xFFE6},   // Fullwidth signs
+	{0x1F300, 0x1FAFF}, // Emoji and pictographs
+	{0x20000, 0x3FFFD}, // CJK extensions
+}
+
+func isWide(r rune) bool {
+	for _, wide := range wideRanges {
+		if r >= wide[0] && r <= wide[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// truncate shortens s to at most max characters, ending it with an ellipsis
+// if anything was cut.
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if max < 1 || len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-1]) + "…"
 }
 
-func (c *Client) handleShell(channel ssh.Channel) {
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// allowMessage reports whether msg from the client may be broadcast, and
+// tells the client why not otherwise. Chat messages and emotes both go
+// through it, so that neither can be used to get around the other's limits.
+func (c *Client) allowMessage(msg *Message) bool {
+	if c.IsSilenced() {
+		c.tell("silenced", c.SilenceRemaining().Round(time.Second))
+		return false
+	}
+	if len(msg.String()) > 1000 {
+		c.tell("message_rejected")
+		return false
+	}
+	if wait := c.slowModeWait(); wait > 0 {
+		c.tell("slow_mode", int(math.Ceil(wait.Seconds())))
+		return false
+	}
+	if !c.msgLimiter.Allow() {
+		c.tell("message_too_fast")
+		return false
+	}
+	c.lastSent = c.Server.Clock()
+	return true
+}
+
+// cooldownWait spends a use of cmd if its cooldown allows, and otherwise
+// returns how long until the client may use it again. Ops have no cooldowns.
+func (c *Client) cooldownWait(cmd *Command) time.Duration {
+	cooldown := c.Server.Cooldown(cmd)
+	if cooldown <= 0 || c.Server.IsOp(c) {
+		return 0
+	}
+	limiter, ok := c.cooldowns[cmd.Name]
+	if !ok {
+		limiter = c.Server.newRateLimiter(cooldown, 1)
+		c.cooldowns[cmd.Name] = limiter
+	}
+	if limiter.Allow() {
+		return 0
+	}
+	return limiter.Wait()
+}
+
+// slowModeWait returns how much longer slow mode keeps the client from
+// sending a message. Ops aren't held back.
+func (c *Client) slowModeWait() time.Duration {
+	interval := c.Server.SlowMode()
+	if interval <= 0 || c.Server.IsOp(c) {
+		return 0
+	}
+	return interval - c.Server.Clock().Sub(c.lastSent)
+}
+
+func (c *Client) handleShell(channel io.Closer) {
 	defer channel.Close()
 
 	// FIXME: This shouldn't live here, need to restructure the call chaining.
 	c.Server.Add(c)
+	c.Server.Welcome(c)
 	go func() {
 		// Block until done, then remove.
 		c.Conn.Wait()
@@ -102,137 +821,155 @@ func (c *Client) handleShell(channel ssh.Channel) {
 	}()
 
 	go func() {
-		for msg := range c.Msg {
-			c.Write(msg)
+		for {
+			select {
+			case msg := <-c.Msg:
+				c.writeQueued(msg)
+			case <-c.ctx.Done():
+				return
+			}
 		}
 	}()
 
+	if conn, ok := c.Conn.(keepaliveConn); ok && c.Server.Keepalive > 0 {
+		go c.keepalive(conn, c.Server.Keepalive)
+	}
+
 	for {
 		line, err := c.term.ReadLine()
 		if err != nil {
 			break
 		}
-
-		parts := strings.SplitN(line, " ", 3)
-		isCmd := strings.HasPrefix(parts[0], "/")
-
-		if isCmd {
-			// TODO: Factor this out.
-			switch parts[0] {
-			case "/exit":
-				channel.Close()
-			case "/help":
-				c.WriteLines(strings.Split(HELP_TEXT, "\n"))
-			case "/about":
-				c.WriteLines(strings.Split(ABOUT_TEXT, "\n"))
-			case "/me":
-				me := strings.TrimLeft(line, "/me")
-				if me == "" {
-					me = " is at a loss for words."
-				}
-				msg := fmt.Sprintf("** %s%s", c.Name, me)
-				if c.IsSilenced() || len(msg) > 1000 {
-					c.Msg <- fmt.Sprintf("-> Message rejected.")
-				} else {
-					c.Server.Broadcast(msg, nil)
-				}
-			case "/nick":
-				if len(parts) == 2 {
-					c.Server.Rename(c, parts[1])
-				} else {
-					c.Msg <- fmt.Sprintf("-> Missing $NAME from: /nick $NAME")
-				}
-			case "/whois":
-				if len(parts) == 2 {
-					client := c.Server.Who(parts[1])
-					if client != nil {
-						version := client.Conn.ClientVersion()
-						if len(version) > 100 {
-							version = []byte("Evil Jerk with a superlong string")
-						}
-						c.Msg <- fmt.Sprintf("-> %s is %s via %s", client.Name, client.Fingerprint(), version)
-					} else {
-						c.Msg <- fmt.Sprintf("-> No such name: %s", parts[1])
-					}
-				} else {
-					c.Msg <- fmt.Sprintf("-> Missing $NAME from: /whois $NAME")
-				}
-			case "/list":
-				names := c.Server.List(nil)
-				c.Msg <- fmt.Sprintf("-> %d connected: %s", len(names), strings.Join(names, ", "))
-			case "/ban":
-				if !c.Server.IsOp(c) {
-					c.Msg <- fmt.Sprintf("-> You're not an admin.")
-				} else if len(parts) != 2 {
-					c.Msg <- fmt.Sprintf("-> Missing $NAME from: /ban $NAME")
-				} else {
-					client := c.Server.Who(parts[1])
-					if client == nil {
-						c.Msg <- fmt.Sprintf("-> No such name: %s", parts[1])
-					} else {
-						fingerprint := client.Fingerprint()
-						client.Write(fmt.Sprintf("-> Banned by %s.", c.Name))
-						c.Server.Ban(fingerprint, nil)
-						client.Conn.Close()
-						c.Server.Broadcast(fmt.Sprintf("* %s was banned by %s", parts[1], c.Name), nil)
-					}
-				}
-			case "/op":
-				if !c.Server.IsOp(c) {
-					c.Msg <- fmt.Sprintf("-> You're not an admin.")
-				} else if len(parts) != 2 {
-					c.Msg <- fmt.Sprintf("-> Missing $NAME from: /op $NAME")
-				} else {
-					client := c.Server.Who(parts[1])
-					if client == nil {
-						c.Msg <- fmt.Sprintf("-> No such name: %s", parts[1])
-					} else {
-						fingerprint := client.Fingerprint()
-						client.Write(fmt.Sprintf("-> Made op by %s.", c.Name))
-						c.Server.Op(fingerprint)
-					}
-				}
-			case "/silence":
-				if !c.Server.IsOp(c) {
-					c.Msg <- fmt.Sprintf("-> You're not an admin.")
-				} else if len(parts) < 2 {
-					c.Msg <- fmt.Sprintf("-> Missing $NAME from: /silence $NAME")
-				} else {
-					duration := time.Duration(5) * time.Minute
-					if len(parts) >= 3 {
-						parsedDuration, err := time.ParseDuration(parts[2])
-						if err == nil {
-							duration = parsedDuration
-						}
-					}
-					client := c.Server.Who(parts[1])
-					if client == nil {
-						c.Msg <- fmt.Sprintf("-> No such name: %s", parts[1])
-					} else {
-						client.Silence(duration)
-						client.Write(fmt.Sprintf("-> Silenced for %s by %s.", duration, c.Name))
-					}
-				}
-			default:
-				c.Msg <- fmt.Sprintf("-> Invalid command: %s", line)
-			}
-			continue
+		c.lineLock.Lock()
+		done := c.handleLine(line)
+		c.lineLock.Unlock()
+		if done {
+			break
 		}
+	}
+	c.flush()
+}
 
-		msg := fmt.Sprintf("%s: %s", c.Name, line)
-		if c.IsSilenced() || len(msg) > 1000 {
-			c.Msg <- fmt.Sprintf("-> Message rejected.")
-			continue
-		}
-		c.Server.Broadcast(msg, c)
+// handleLine runs the command or sends the chat message on line, and reports
+// whether it ended the session. The caller holds lineLock.
+func (c *Client) handleLine(line string) bool {
+	if c.touch() {
+		c.Back()
+	}
+	if utf8.RuneCountInString(line) >= MAX_LINE_LENGTH {
+		c.tell("line_too_long")
+		return false
+	}
+
+	if strings.HasPrefix(line, "/") {
+		c.flushPending()
+		commands.Run(c, line)
+		// The command may have ended the session, as /exit does.
+		return c.ctx.Err() != nil
 	}
 
+	if strings.TrimSpace(line) == "" {
+		return false
+	}
+	if c.coalesce(line) {
+		return false
+	}
+
+	// The terminal already shows what was typed, so don't echo it.
+	// Emotes and edits are sent back, as they look different from
+	// the command that was typed.
+	c.say(line, false)
+	return false
 }
 
-func (c *Client) handleChannels(channels <-chan ssh.NewChannel) {
-	prompt := fmt.Sprintf("[%s] ", c.Name)
+// coalesce holds line back if it's short and the server coalesces short
+// messages, to be sent with the short lines that follow it within
+// CoalesceWindow. It reports whether it did. Lines held back earlier are sent
+// first either way. The caller holds lineLock.
+func (c *Client) coalesce(line string) bool {
+	window, max := c.Server.CoalesceWindow, c.Server.CoalesceMax
+	line = strings.TrimSpace(line)
+	if window <= 0 || utf8.RuneCountInString(line) > COALESCE_LENGTH {
+		c.flushPending()
+		return false
+	}
+	c.pending = append(c.pending, line)
+	if max > 0 && len(c.pending) >= max {
+		c.flushPending()
+	} else if c.pendingTimer == nil {
+		c.pendingTimer = time.AfterFunc(window, c.flush)
+	}
+	return true
+}
 
-	hasShell := false
+// flush sends the lines held back by coalesce as one message.
+func (c *Client) flush() {
+	c.lineLock.Lock()
+	defer c.lineLock.Unlock()
+	c.flushPending()
+}
+
+// flushPending is flush for callers that hold lineLock. Once the client has
+// been removed, the lines are dropped instead, as its leave may already have
+// been announced.
+func (c *Client) flushPending() {
+	if c.pendingTimer != nil {
+		c.pendingTimer.Stop()
+		c.pendingTimer = nil
+	}
+	if len(c.pending) == 0 {
+		return
+	}
+	if c.ctx.Err() != nil {
+		c.pending = nil
+		return
+	}
+	line := strings.Join(c.pending, " ")
+	c.pending = nil
+	c.say(line, false)
+}
+
+// say sends line to the room as a chat message from the client, and to the
+// client too if echo is set.
+func (c *Client) say(line string, echo bool) {
+	msg := NewChatMsg(c, line)
+	if !c.allowMessage(msg) {
+		return
+	}
+	if c.IsAway() {
+		c.Back()
+	}
+	c.lastMsg, c.lastMsgAt = line, c.Server.Clock()
+	c.sent = append(c.sent, line)
+	if len(c.sent) > SENT_HISTORY {
+		c.sent = c.sent[len(c.sent)-SENT_HISTORY:]
+	}
+	if echo {
+		c.Server.BroadcastMessage(msg, nil)
+	} else {
+		c.Server.BroadcastMessage(msg, c)
+	}
+}
+
+// keepalive sends a keepalive over conn every interval until the client is
+// removed. It doesn't count as activity, so idle clients still go away.
+func (c *Client) keepalive(conn keepaliveConn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.Keepalive(); err != nil {
+				logger.Debugf("Failed to send keepalive to %s: %v", c.Name, err)
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Client) handleChannels(channels <-chan ssh.NewChannel) {
+	prompt := c.prompt()
 
 	for ch := range channels {
 		if t := ch.ChannelType(); t != "session" {
@@ -247,24 +984,38 @@ func (c *Client) handleChannels(channels <-chan ssh.NewChannel) {
 		}
 		defer channel.Close()
 
+		if c.hasShell {
+			// The client is already in the room, so a shell on this
+			// channel would put it there twice. Its terminal is left alone.
+			c.refuseRequests(requests)
+			continue
+		}
+
 		c.term = terminal.NewTerminal(channel, prompt)
 		for req := range requests {
 			var width, height int
+			var term, name, value string
 			var ok bool
 
 			switch req.Type {
 			case "shell":
-				if c.term != nil && !hasShell {
+				if c.term != nil && !c.hasShell {
 					go c.handleShell(channel)
 					ok = true
-					hasShell = true
+					c.hasShell = true
 				}
 			case "pty-req":
-				width, height, ok = parsePtyRequest(req.Payload)
-				if ok {
-					err := c.Resize(width, height)
-					ok = err == nil
+				// A missing or zero size still gets a pty at the default size.
+				term, width, height, _ = parsePtyRequest(req.Payload)
+				if !c.hasShell && term != "" {
+					c.setEnv("TERM", term)
 				}
+				err := c.Resize(width, height)
+				ok = err == nil
+			case "env":
+				// Only the environment from before the shell starts is used.
+				name, value, ok = parseEnvRequest(req.Payload)
+				ok = ok && !c.hasShell && c.setEnv(name, value)
 			case "window-change":
 				width, height, ok = parseWinchRequest(req.Payload)
 				if ok {
@@ -279,3 +1030,16 @@ func (c *Client) handleChannels(channels <-chan ssh.NewChannel) {
 		}
 	}
 }
+
+// refuseRequests refuses everything asked on a session channel opened after
+// the shell started on another.
+func (c *Client) refuseRequests(requests <-chan *ssh.Request) {
+	for req := range requests {
+		if req.Type == "shell" {
+			logger.Warningf("Refusing a second shell from %s (%s)", c.Conn.User(), c.RemoteIP())
+		}
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
@@ -0,0 +1,789 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func TestClientLifecycleLeak(t *testing.T) {
+	server := newTestServer(t)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		channel := newFakeChannel()
+		client := newTestConnClient(server, "leaky", channel)
+		done := make(chan struct{})
+		go func() {
+			client.handleShell(channel)
+			close(done)
+		}()
+
+		channel.In.Write([]byte("hello\r"))
+		client.Conn.Close()
+		channel.Close()
+		<-done
+	}
+
+	// Give the goroutines a moment to unwind.
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Leaked %d goroutines over 10 connections.", after-before)
+	}
+	if n := server.Len(); n != 0 {
+		t.Errorf("Wrong number of clients: %v", n)
+	}
+}
+
+func TestExitUnwinds(t *testing.T) {
+	server := newTestServer(t)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		channel := newFakeChannel()
+		client := newTestConnClient(server, "leaving", channel)
+		done := make(chan struct{})
+		go func() {
+			client.handleShell(channel)
+			close(done)
+		}()
+
+		// Nothing else closes the fake channel, so the session has to
+		// end on its own.
+		channel.In.Write([]byte("/exit bye\r"))
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Session didn't end after /exit.")
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Leaked %d goroutines over 10 sessions ended with /exit.", after-before)
+	}
+	if n := server.Len(); n != 0 {
+		t.Errorf("Wrong number of clients: %v", n)
+	}
+	if len(server.history.Search("leaving left (bye).")) != 10 {
+		t.Errorf("Leaves weren't announced: %q", server.history.Get(10))
+	}
+}
+
+// keepaliveFakeConn is a fakeConn that counts keepalives.
+type keepaliveFakeConn struct {
+	*fakeConn
+	keepalives int32
+}
+
+func (c *keepaliveFakeConn) Keepalive() error {
+	atomic.AddInt32(&c.keepalives, 1)
+	return nil
+}
+
+func TestKeepalive(t *testing.T) {
+	server := newTestServer(t)
+	server.Keepalive = 10 * time.Millisecond
+	conn := &keepaliveFakeConn{fakeConn: newFakeConn("alice")}
+	channel := newFakeChannel()
+	client := newTestConnClient(server, "alice", channel)
+	client.Conn = conn
+	active := client.lastActive
+	done := make(chan struct{})
+	go func() {
+		client.handleShell(channel)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&conn.keepalives) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&conn.keepalives); n < 3 {
+		t.Errorf("Sent %d keepalives, expected at least 3.", n)
+	}
+	conn.Close()
+	channel.Close()
+	<-done
+	if !client.lastActive.Equal(active) {
+		t.Errorf("Keepalives counted as activity.")
+	}
+}
+
+// fakeNewChannel is an ssh.NewChannel for a session that's accepted as
+// channel, with requests fed through Requests.
+type fakeNewChannel struct {
+	channel  ssh.Channel
+	Requests chan *ssh.Request
+}
+
+func (c *fakeNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	return c.channel, c.Requests, nil
+}
+func (c *fakeNewChannel) Reject(reason ssh.RejectionReason, message string) error { return nil }
+func (c *fakeNewChannel) ChannelType() string                                     { return "session" }
+func (c *fakeNewChannel) ExtraData() []byte                                       { return nil }
+
+func ptyRequestPayload(term string, width, height uint32) []byte {
+	payload := make([]byte, 4+len(term)+16)
+	binary.BigEndian.PutUint32(payload, uint32(len(term)))
+	copy(payload[4:], term)
+	binary.BigEndian.PutUint32(payload[4+len(term):], width)
+	binary.BigEndian.PutUint32(payload[8+len(term):], height)
+	return payload
+}
+
+func TestSecondShell(t *testing.T) {
+	server := newTestServer(t)
+	conn := newFakeConn("alice")
+	defer conn.Close()
+	client := NewClient(server, conn)
+
+	first := &fakeNewChannel{channel: newFakeChannel(), Requests: make(chan *ssh.Request, 1)}
+	first.Requests <- &ssh.Request{Type: "shell"}
+	close(first.Requests)
+	second := &recordingChannel{fakeChannel: newFakeChannel()}
+	secondSession := &fakeNewChannel{channel: second, Requests: make(chan *ssh.Request, 2)}
+	secondSession.Requests <- &ssh.Request{Type: "pty-req", Payload: ptyRequestPayload("xterm", 100, 40)}
+	secondSession.Requests <- &ssh.Request{Type: "shell"}
+	close(secondSession.Requests)
+
+	channels := make(chan ssh.NewChannel, 2)
+	channels <- first
+	channels <- secondSession
+	close(channels)
+	client.handleChannels(channels)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for server.Len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := server.Len(); n != 1 {
+		t.Errorf("One connection joined %d times.", n)
+	}
+	if second.written.Len() != 0 || client.termWidth == 100 {
+		t.Errorf("The second session got a terminal.")
+	}
+}
+
+func TestZeroSizePty(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestConnClient(server, "tiny", newFakeChannel())
+
+	channels := make(chan ssh.NewChannel, 1)
+	session := &fakeNewChannel{channel: newFakeChannel(), Requests: make(chan *ssh.Request, 1)}
+	channels <- session
+	close(channels)
+
+	session.Requests <- &ssh.Request{Type: "pty-req", Payload: ptyRequestPayload("xterm", 0, 0)}
+	close(session.Requests)
+	client.handleChannels(channels)
+
+	if client.termWidth != DEFAULT_WIDTH || client.termHeight != DEFAULT_HEIGHT {
+		t.Errorf("Got %dx%d, Expected %dx%d", client.termWidth, client.termHeight, DEFAULT_WIDTH, DEFAULT_HEIGHT)
+	}
+
+	client.Resize(100, 0)
+	if client.termWidth != DEFAULT_WIDTH || client.termHeight != DEFAULT_HEIGHT {
+		t.Errorf("Got %dx%d, Expected %dx%d", client.termWidth, client.termHeight, DEFAULT_WIDTH, DEFAULT_HEIGHT)
+	}
+}
+
+func envRequestPayload(name, value string) []byte {
+	payload := make([]byte, 8+len(name)+len(value))
+	binary.BigEndian.PutUint32(payload, uint32(len(name)))
+	copy(payload[4:], name)
+	binary.BigEndian.PutUint32(payload[4+len(name):], uint32(len(value)))
+	copy(payload[8+len(name):], value)
+	return payload
+}
+
+func TestColorFromEnv(t *testing.T) {
+	tests := []struct {
+		requests []*ssh.Request
+		want     *Theme
+	}{
+		{[]*ssh.Request{{Type: "pty-req", Payload: ptyRequestPayload("xterm", 80, 24)}}, DefaultTheme},
+		{[]*ssh.Request{{Type: "pty-req", Payload: ptyRequestPayload("dumb", 80, 24)}}, MonochromeTheme},
+		{[]*ssh.Request{{Type: "env", Payload: envRequestPayload("TERM", "dumb")}}, MonochromeTheme},
+		{[]*ssh.Request{{Type: "env", Payload: envRequestPayload("NO_COLOR", "1")}}, MonochromeTheme},
+	}
+	for _, test := range tests {
+		server := newTestServer(t)
+		client := newTestConnClient(server, "alice", newFakeChannel())
+
+		channels := make(chan ssh.NewChannel, 1)
+		session := &fakeNewChannel{channel: newFakeChannel(), Requests: make(chan *ssh.Request, len(test.requests))}
+		channels <- session
+		close(channels)
+		for _, req := range test.requests {
+			session.Requests <- req
+		}
+		close(session.Requests)
+		client.handleChannels(channels)
+
+		if client.theme != test.want {
+			t.Errorf("%s %q: got theme %s, expected %s", test.requests[0].Type, test.requests[0].Payload, client.theme.Name, test.want.Name)
+		}
+	}
+
+	server := newTestServer(t)
+	client := newTestClient(server, "alice")
+	client.setEnv("TERM", "dumb")
+	commands.Run(client, "/set color on")
+	<-client.Msg
+	if client.theme != DefaultTheme {
+		t.Errorf("/set color on didn't turn color back on.")
+	}
+}
+
+func TestEnvRequests(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestConnClient(server, "alice", newFakeChannel())
+
+	channels := make(chan ssh.NewChannel, 1)
+	session := &fakeNewChannel{channel: newFakeChannel(), Requests: make(chan *ssh.Request, 3)}
+	channels <- session
+	close(channels)
+	session.Requests <- &ssh.Request{Type: "env", Payload: envRequestPayload("LANG", "en_US.UTF-8")}
+	session.Requests <- &ssh.Request{Type: "env", Payload: []byte("garbage")}
+	session.Requests <- &ssh.Request{Type: "pty-req", Payload: ptyRequestPayload("xterm-256color", 80, 24)}
+	close(session.Requests)
+	client.handleChannels(channels)
+
+	if got := client.Env("LANG"); got != "en_US.UTF-8" {
+		t.Errorf("Got LANG %q", got)
+	}
+	if got := client.Env("TERM"); got != "xterm-256color" {
+		t.Errorf("Got TERM %q", got)
+	}
+
+	for i := len(client.env); i < MAX_ENV; i++ {
+		if !client.setEnv(fmt.Sprintf("VAR%d", i), "x") {
+			t.Fatalf("Variable %d was refused.", i)
+		}
+	}
+	if client.setEnv("ONE_TOO_MANY", "x") || client.Env("ONE_TOO_MANY") != "" {
+		t.Errorf("Kept more than %d variables.", MAX_ENV)
+	}
+	if !client.setEnv("LANG", "C") {
+		t.Errorf("Couldn't replace a variable when full.")
+	}
+	if client.setEnv("LANG", strings.Repeat("x", MAX_ENV_LENGTH)) {
+		t.Errorf("Kept a variable longer than %d.", MAX_ENV_LENGTH)
+	}
+}
+
+func TestChatNameFromEnv(t *testing.T) {
+	server := newTestServer(t)
+	server.MaxNameLength = 8
+	newTestClient(server, "bob")
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"robert", "robert"},
+		{"a very long name", "averylon"},
+		{"!!!", "alice"},
+		{"bob", "guest_"},
+	}
+	for _, test := range tests {
+		client := newTestConnClient(server, "alice", newFakeChannel())
+		client.setEnv(CHAT_NAME_ENV, test.value)
+		server.Add(client)
+		if !strings.HasPrefix(client.Name, test.want) {
+			t.Errorf("%s=%q joined as %q, expected %q", CHAT_NAME_ENV, test.value, client.Name, test.want)
+		}
+		server.Remove(client)
+	}
+}
+
+func TestUTF8Locale(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		want bool
+	}{
+		{nil, true},
+		{map[string]string{"LANG": "en_US.UTF-8"}, true},
+		{map[string]string{"LANG": "de_DE.utf8"}, true},
+		{map[string]string{"LANG": "C"}, false},
+		{map[string]string{"LANG": "en_US.UTF-8", "LC_CTYPE": "en_US.ISO-8859-1"}, false},
+		{map[string]string{"LC_ALL": "en_US.UTF-8", "LC_CTYPE": "POSIX"}, true},
+	}
+	server := newTestServer(t)
+	for _, test := range tests {
+		client := newTestClient(server, "alice")
+		client.env = test.env
+		if got := client.UTF8(); got != test.want {
+			t.Errorf("%v: got %v, expected %v", test.env, got, test.want)
+		}
+	}
+
+	client := newTestClient(server, "alice")
+	term := &fakeTerminal{}
+	client.term = term
+	client.env = map[string]string{"LANG": "C"}
+	client.Write("caf\u00e9 \U0001F600 \u4e2d e\u0301 " + truncate("abcdef", 4))
+	if want := "write caf\u00e9 ? ? e? abc\u2026\r\n"; len(term.calls) != 1 || term.calls[0] != want {
+		t.Errorf("Got %q, expected %q", term.calls, want)
+	}
+}
+
+func TestBlankMessagesIgnored(t *testing.T) {
+	server := newTestServer(t)
+	channel := newFakeChannel()
+	client := newTestConnClient(server, "blank", channel)
+	done := make(chan struct{})
+	go func() {
+		client.handleShell(channel)
+		close(done)
+	}()
+
+	channel.In.Write([]byte("\r   \r/me\r/me   \rhi\r"))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(server.history.Search("blank: hi")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Conn.Close()
+	channel.Close()
+	<-done
+
+	for _, entry := range server.history.Entries(server.history.Cap()) {
+		if strings.HasPrefix(entry.Msg, "** blank") || (strings.HasPrefix(entry.Msg, "blank:") && entry.Msg != "blank: hi") {
+			t.Errorf("Blank message was broadcast: %q", entry.Msg)
+		}
+	}
+	if len(server.history.Search("blank: hi")) != 1 {
+		t.Errorf("Message after the blank ones wasn't broadcast.")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"SSH-2.0-OpenSSH", 100, "SSH-2.0-OpenSSH"},
+		{"SSH-2.0-OpenSSH", 8, "SSH-2.0…"},
+		{"ééééé", 3, "éé…"},
+		{"ééééé", 5, "ééééé"},
+		{"anything", 0, "anything"},
+	}
+	for _, test := range tests {
+		if got := truncate(test.in, test.max); got != test.want {
+			t.Errorf("truncate(%q, %d) = %q, expected %q", test.in, test.max, got, test.want)
+		}
+	}
+}
+
+func TestVersionSanitized(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server, "evil")
+	client.Conn.(*fakeConn).version = []byte("SSH-2.0-\x1b[2J\x1b[31mEvil\x1b]0;pwned\x07\x1bc\r\n\x9bClient")
+
+	version := client.Version()
+	if version != "SSH-2.0-Evil???Client" {
+		t.Errorf("Got %q", version)
+	}
+	for _, r := range version {
+		if unicode.IsControl(r) {
+			t.Errorf("Version %q has control character %q", version, r)
+		}
+	}
+}
+
+func TestSoftwareName(t *testing.T) {
+	tests := map[string]string{
+		"SSH-2.0-OpenSSH_9.6":                    "OpenSSH 9.6",
+		"SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13": "OpenSSH 9.6p1",
+		"SSH-2.0-PuTTY_Release_0.79":             "PuTTY Release 0.79",
+		"SSH-2.0-Go":                             "Go",
+		"SSH-1.99-dropbear_2022.83":              "dropbear 2022.83",
+		"SSH-2.0-":                               "SSH-2.0-",
+		"telnet":                                 "telnet",
+		"SSH-2.0-Evil???Client":                  "Evil???Client",
+	}
+	for version, want := range tests {
+		if got := softwareName(version); got != want {
+			t.Errorf("softwareName(%q) = %q, expected %q", version, got, want)
+		}
+	}
+}
+
+func TestEmoteThrottled(t *testing.T) {
+	server := newTestServer(t)
+	server.MessageInterval = time.Hour
+	channel := newFakeChannel()
+	client := newTestConnClient(server, "flood", channel)
+	done := make(chan struct{})
+	go func() {
+		client.handleShell(channel)
+		close(done)
+	}()
+
+	for i := 0; i < MESSAGE_BURST*2; i++ {
+		channel.In.Write([]byte("/me floods\r"))
+	}
+	// The rename is announced after every /me has been handled.
+	channel.In.Write([]byte("/nick flooded\r"))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(server.history.Search("now known as flooded")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Conn.Close()
+	channel.Close()
+	<-done
+
+	if n := len(server.history.Search("** flood floods")); n != MESSAGE_BURST {
+		t.Errorf("Broadcast %d emotes, expected %d", n, MESSAGE_BURST)
+	}
+}
+
+func TestLongLineDropped(t *testing.T) {
+	server := newTestServer(t)
+	channel := &recordingChannel{fakeChannel: newFakeChannel()}
+	client := newTestConnClient(server, "long", channel)
+	done := make(chan struct{})
+	go func() {
+		client.handleShell(channel)
+		close(done)
+	}()
+
+	channel.In.Write([]byte("/nick " + strings.Repeat("x", MAX_LINE_LENGTH) + "\r"))
+	channel.In.Write([]byte(strings.Repeat("y", MAX_LINE_LENGTH+10) + "\rok\r"))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(server.history.Search("long: ok")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Conn.Close()
+	channel.Close()
+	<-done
+
+	if len(server.history.Search("long: ok")) != 1 {
+		t.Errorf("Message after the long line wasn't broadcast.")
+	}
+	if len(server.history.Search("now known as")) != 0 {
+		t.Errorf("Long line was parsed as a command.")
+	}
+	if len(server.history.Search("yyyy")) != 0 {
+		t.Errorf("Long line was cut short and broadcast.")
+	}
+	if n := strings.Count(channel.written.String(), "Line too long."); n != 2 {
+		t.Errorf("Told about %d of 2 long lines.", n)
+	}
+}
+
+// fakeTerminal records what's done to it, in order.
+type fakeTerminal struct {
+	calls []string
+}
+
+func (t *fakeTerminal) Write(p []byte) (int, error) {
+	t.calls = append(t.calls, "write "+string(p))
+	return len(p), nil
+}
+func (t *fakeTerminal) ReadLine() (string, error)           { return "", nil }
+func (t *fakeTerminal) SetPrompt(prompt string)             { t.calls = append(t.calls, "prompt "+prompt) }
+func (t *fakeTerminal) SetSize(width int, height int) error { return nil }
+
+// failingResizeTerminal is a fakeTerminal that refuses every size.
+type failingResizeTerminal struct {
+	fakeTerminal
+}
+
+func (t *failingResizeTerminal) SetSize(width int, height int) error { return errors.New("no") }
+
+// failingWriteTerminal is a fakeTerminal whose writes fail, like one on a
+// broken pipe.
+type failingWriteTerminal struct {
+	fakeTerminal
+}
+
+func (t *failingWriteTerminal) Write(p []byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestWriteFailures(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestConnClient(server, "alice", newFakeChannel())
+	server.Add(client)
+	term := &failingWriteTerminal{}
+	client.term = term
+
+	for i := int32(1); i < MAX_WRITE_FAILURES; i++ {
+		if err := client.Write("hello"); err == nil {
+			t.Fatal("Expected an error")
+		}
+	}
+	if server.Who("alice") != client {
+		t.Fatalf("Removed before %d failed writes.", MAX_WRITE_FAILURES)
+	}
+
+	// A write that goes through starts the count over.
+	client.term = &fakeTerminal{}
+	client.Write("hello")
+	client.term = term
+	for i := int32(1); i < MAX_WRITE_FAILURES; i++ {
+		client.Write("hello")
+	}
+	if server.Who("alice") != client {
+		t.Fatalf("Failures weren't reset by a good write.")
+	}
+
+	if err := client.WriteLines([]string{"one", "two"}); err == nil {
+		t.Error("Expected an error from WriteLines")
+	}
+	if server.Who("alice") != nil || client.ctx.Err() == nil {
+		t.Errorf("Client wasn't removed after repeated failed writes.")
+	}
+	select {
+	case <-client.Conn.(*fakeConn).closed:
+	default:
+		t.Errorf("Client wasn't disconnected.")
+	}
+}
+
+func TestResizeFailures(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server, "alice")
+	client.term = &fakeTerminal{}
+
+	client.Resize(1<<30, 50)
+	if client.termWidth != MAX_TERM_SIZE || client.termHeight != 50 {
+		t.Errorf("Huge size wasn't clamped: %dx%d", client.termWidth, client.termHeight)
+	}
+
+	client.Resize(120, 40)
+	client.term = &failingResizeTerminal{}
+	for i := 0; i < 100; i++ {
+		if err := client.Resize(90, 30); err == nil {
+			t.Fatal("Expected an error")
+		}
+	}
+	if client.termWidth != 120 || client.termHeight != 40 || !client.termSized {
+		t.Errorf("Lost the last good size, got %dx%d", client.termWidth, client.termHeight)
+	}
+	if client.resizeFails != 100 || client.resizeLog.Allow() {
+		t.Errorf("Failures weren't rate limited, %d counted", client.resizeFails)
+	}
+	if client.ctx.Err() != nil {
+		t.Errorf("Failed resizes ended the session.")
+	}
+}
+
+func TestRenameRedrawsPrompt(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server, "alice")
+	term := &fakeTerminal{}
+	client.term = term
+
+	client.Rename("bob")
+	want := []string{"prompt [bob] ", "write "}
+	if strings.Join(term.calls, "|") != strings.Join(want, "|") {
+		t.Errorf("Got %q, expected %q", term.calls, want)
+	}
+}
+
+// blockingTerminal is a fakeTerminal whose writes block until unblock is
+// closed, like one whose client stopped reading.
+type blockingTerminal struct {
+	fakeTerminal
+	unblock chan struct{}
+}
+
+func (t *blockingTerminal) Write(p []byte) (int, error) {
+	<-t.unblock
+	return len(p), nil
+}
+
+func TestRenameStalledClient(t *testing.T) {
+	server := newTestServer(t)
+	server.NickInterval = 0
+	client := newTestClient(server, "alice")
+	term := &blockingTerminal{unblock: make(chan struct{})}
+	client.term = term
+	defer close(term.unblock)
+
+	go server.Rename(client, "bob")
+	deadline := time.Now().Add(2 * time.Second)
+	for server.Who("bob") == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The prompt is stuck being redrawn, but that mustn't stop the server.
+	locked := make(chan struct{})
+	go func() {
+		server.lock.Lock()
+		server.lock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Renaming a stalled client held the server's lock.")
+	}
+}
+
+func TestSilenceWithClock(t *testing.T) {
+	server := newTestServer(t)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	server.Clock = func() time.Time { return now }
+	client := newTestClient(server, "alice")
+
+	server.Silence(client, 5*time.Minute)
+	now = now.Add(4 * time.Minute)
+	if !client.IsSilenced() || client.SilenceRemaining() != time.Minute {
+		t.Errorf("Silenced %v with %s left, expected a minute left", client.IsSilenced(), client.SilenceRemaining())
+	}
+	now = now.Add(2 * time.Minute)
+	if client.IsSilenced() {
+		t.Errorf("Still silenced after the silence expired.")
+	}
+
+	duration := time.Hour
+	server.Ban("fp-bob", &duration, "")
+	now = now.Add(59 * time.Minute)
+	if !server.IsBanned("fp-bob") {
+		t.Errorf("Ban expired early.")
+	}
+	now = now.Add(2 * time.Minute)
+	if server.IsBanned("fp-bob") {
+		t.Errorf("Ban didn't expire.")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	server := newTestServer(t)
+	keyed := newTestConnClient(server, "alice", newFakeChannel())
+	if keyed.Identity() != "fp-alice" {
+		t.Errorf("Client with a key has identity %q", keyed.Identity())
+	}
+
+	keyless := func(name string) *Client {
+		conn := newFakeConn(name)
+		conn.fingerprint = ""
+		client := NewClient(server, conn)
+		client.term = terminal.NewTerminal(newFakeChannel(), "")
+		return client
+	}
+	bob, carol := keyless("bob"), keyless("carol")
+	if bob.Identity() == "" || bob.Identity() == carol.Identity() {
+		t.Errorf("Clients without keys share identity %q", bob.Identity())
+	}
+
+	// A silence sticks to a client without a key when it reconnects.
+	server.Add(bob)
+	server.Silence(bob, time.Hour)
+	server.Leave(bob, "bye")
+	again := keyless("bob")
+	server.Add(again)
+	if !again.IsSilenced() {
+		t.Errorf("Reconnecting cleared the silence of a client without a key.")
+	}
+}
+
+func TestPage(t *testing.T) {
+	server := newTestServer(t)
+	channel := &recordingChannel{fakeChannel: newFakeChannel()}
+	client := newTestConnClient(server, "alice", channel)
+	lines := []string{"one", "two", "three", "four", "five", "six", "seven"}
+
+	// Without a size, there's nothing to wait for.
+	client.Page(lines)
+	if got := strings.Count(channel.written.String(), "\r\n"); got != len(lines) {
+		t.Errorf("Unsized terminal got %d lines: %q", got, channel.written.String())
+	}
+
+	channel.written.Reset()
+	client.Resize(80, 4)
+	go func() {
+		channel.In.Write([]byte("\r"))
+		channel.In.Write([]byte("q\r"))
+	}()
+	client.Page(lines)
+	got := channel.written.String()
+	if !strings.Contains(got, "six") || strings.Contains(got, "seven") {
+		t.Errorf("Paging didn't stop after the second screen: %q", got)
+	}
+	if !strings.Contains(got, "1 more lines not shown.") {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	server := newTestServer(t)
+	server.MessageInterval = 0
+	client := newTestClient(server, "alice")
+	say := func(line string) {
+		client.lineLock.Lock()
+		client.handleLine(line)
+		client.lineLock.Unlock()
+	}
+
+	// Off by default.
+	say("a")
+	if len(server.history.Search("alice: a")) != 1 {
+		t.Fatalf("Short line was held back without --coalesce-window.")
+	}
+
+	server.CoalesceWindow = 20 * time.Millisecond
+	server.CoalesceMax = 3
+	say("b")
+	say(" c ")
+	if len(server.history.Search("alice: b")) != 0 {
+		t.Fatalf("Short line wasn't held back.")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(server.history.Search("alice: b c")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(server.history.Search("alice: b c")) != 1 {
+		t.Errorf("Short lines weren't sent together: %q", server.history.Get(10))
+	}
+
+	// CoalesceMax lines are sent right away, and a longer line or a
+	// command sends what's held back before it.
+	server.CoalesceWindow = time.Hour
+	say("d")
+	say("e")
+	say("f")
+	say("g")
+	say("not short")
+	got := server.history.Get(3)
+	want := []string{"alice: d e f", "alice: g", "alice: not short"}
+	for i := range want {
+		if !strings.HasSuffix(got[i], want[i]) {
+			t.Errorf("Got %q, expected %q", got, want)
+			break
+		}
+	}
+	say("h")
+	say("/me waves")
+	if got := server.history.Get(2); !strings.HasSuffix(got[0], "alice: h") {
+		t.Errorf("Command jumped ahead of a held back line: %q", got)
+	}
+
+	// Lines held back when the client leaves aren't sent after its leave.
+	say("i")
+	client.cancel()
+	client.flush()
+	if len(server.history.Search("alice: i")) != 0 {
+		t.Errorf("Held back line was sent after leaving: %q", server.history.Get(3))
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "time"
+
+// Clock tells the time. The parts of the server are given Server.Clock, so
+// that tests control their time too, and a nil Clock is the real time.
+type Clock func() time.Time
+
+// Now returns the time from c, or time.Now if c is nil.
+func (c Clock) Now() time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c()
+}
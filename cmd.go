@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/alexcesaro/log"
 	"github.com/alexcesaro/log/golog"
@@ -12,10 +14,70 @@ import (
 )
 
 type Options struct {
-	Verbose  []bool `short:"v" long:"verbose" description:"Show verbose logging."`
-	Identity string `short:"i" long:"identity" description:"Private key to identify server with." default:"~/.ssh/id_rsa"`
-	Bind     string `long:"bind" description:"Host and port to listen on." default:"0.0.0.0:22"`
-	Admin    string `long:"admin" description:"Fingerprint of pubkey to mark as admin."`
+	Verbose    []bool `short:"v" long:"verbose" description:"Show verbose logging."`
+	Identity   string `short:"i" long:"identity" description:"Private key to identify server with." default:"~/.ssh/id_rsa"`
+	Bind       string `long:"bind" description:"Host and port to listen on." default:"0.0.0.0:22"`
+	Admin      string `long:"admin" description:"Fingerprint of pubkey to mark as admin."`
+	Motd       string `long:"motd" description:"File with the message of the day shown on join."`
+	Banner     string `long:"banner" description:"File with a short notice shown by SSH clients before login."`
+	BannerArt  string `long:"banner-art" description:"File with ASCII art sent to clients as they connect."`
+	Name       string `long:"name" description:"Name of the room, shown on joining and above the MOTD." default:"ssh-chat"`
+	Greeting   string `long:"greeting" description:"Greeting sent after the MOTD, $NAME is replaced with the user's name."`
+	OpFile     string `long:"opfile" description:"File of admin pubkey fingerprints, one per line."`
+	BanFile    string `long:"banfile" description:"File of banned pubkey fingerprints, one per line."`
+	BadgeFile  string `long:"badgefile" description:"File to keep badges given with /badge in, a fingerprint and badge per line."`
+	PinFile    string `long:"pinfile" description:"File to keep the message pinned with /pin in, so it survives a restart."`
+	Lang       string `long:"lang" description:"JSON file translating the replies and notices sent to users in the chat, by key. Missing ones stay in English. Reloaded on SIGHUP."`
+	Responders string `long:"responders" description:"JSON file of auto-responder rules. Reloaded on SIGHUP."`
+	Config     string `long:"config" description:"JSON config file. Flags take precedence over its values. Reloaded on SIGHUP."`
+	Check      bool   `long:"check" description:"Load the config, identity, and files, report any errors, and exit without listening."`
+
+	TelnetAddr string `long:"telnet-addr" description:"Host and port to accept UNENCRYPTED telnet guests on. Off unless set."`
+	WSAddr     string `long:"ws-addr" description:"Host and port to accept WebSocket clients on. Off unless set."`
+	HTTPAddr   string `long:"http-addr" description:"Host and port to serve HTTP on, with /healthz for load balancers. Off unless set."`
+	WSToken    string `long:"ws-token" description:"Token WebSocket clients must give to pick a name. Without one, they join as guests."`
+	OnEmpty    string `long:"on-empty" description:"What to do when the last user leaves: log, or an http(s) URL to POST the event to as JSON. Off unless set."`
+
+	Bot      []string `long:"bot" description:"Enable a bot by name, one of: echo. Can be repeated."`
+	WSOrigin []string `long:"ws-origin" description:"Origin besides the server's own that browsers may open WebSockets from, like https://example.com, or * for any. Can be repeated."`
+
+	PersistOps  bool `long:"persist-ops" description:"Save changes made with /op and /deop to the op file."`
+	PersistMotd bool `long:"persist-motd" description:"Save changes made with /setmotd and /appendmotd to the MOTD file."`
+	RoomPrompt  bool `long:"room-prompt" description:"Show the room's name in everyone's prompt."`
+
+	SilenceDefault time.Duration `long:"silence-default" description:"Duration of /silence when none is given." default:"5m"`
+	SilencePublic  bool          `long:"silence-public" description:"Announce silences to the whole room."`
+	LoginAttempts  int           `long:"login-attempts" description:"Failed logins from an IP before it's locked out, 0 to disable." default:"5"`
+	LoginLockout   time.Duration `long:"login-lockout" description:"Initial lockout after repeated failed logins, doubling on each further failure." default:"1m"`
+	AwayAfter      time.Duration `long:"away-after" description:"Mark users away after being idle this long, 0 to disable." default:"10m"`
+	IdleTimeout    time.Duration `long:"idletimeout" description:"Disconnect users after being idle this long, 0 to disable. Must be longer than --away-after."`
+	Keepalive      time.Duration `long:"keepalive" description:"Send each client a keepalive they won't see this often, for connections that are dropped when quiet. Off unless set."`
+
+	HandshakeTimeout time.Duration `long:"handshake-timeout" description:"How long a connection has to finish the SSH handshake before it's dropped, 0 to wait indefinitely." default:"10s"`
+
+	JanitorInterval time.Duration `long:"janitor-interval" description:"How often to clear out expired bans, silences, mentions, and login failures, 0 to disable." default:"10m"`
+	MuteNotices     time.Duration `long:"mute-notices-default" description:"Duration of /mutenotices when none is given." default:"5m"`
+	MentionTTL      time.Duration `long:"mention-ttl" description:"How long mentions are kept for users who are away or have left." default:"24h"`
+
+	CoalesceWindow time.Duration `long:"coalesce-window" description:"Experimental: hold back chat lines of up to 3 characters this long, to send a burst of them as one message. Off unless set."`
+	CoalesceMax    int           `long:"coalesce-max" description:"Most short lines sent as one message with --coalesce-window." default:"5"`
+
+	HistoryLen   int `long:"history-len" description:"Number of messages kept for replay, /last, and /search." default:"20"`
+	HistoryBytes int `long:"history-bytes" description:"Total size of messages kept in history, 0 for no limit." default:"65536"`
+
+	MessageInterval time.Duration `long:"message-interval" description:"Per client, regain one message every interval, 0 to disable the limit." default:"1s"`
+	MessageBurst    int           `long:"message-burst" description:"Per client, messages that can be sent in a burst." default:"5"`
+	NickInterval    time.Duration `long:"nick-interval" description:"Per client, regain one name change every interval, 0 to disable the limit." default:"30s"`
+	NickBurst       int           `long:"nick-burst" description:"Per client, name changes that can be made in a burst." default:"3"`
+	QueryInterval   time.Duration `long:"query-interval" description:"Per client, regain one use of /list or /whois every interval, 0 to disable the limit. Ops are exempt." default:"5s"`
+	QueryBurst      int           `long:"query-burst" description:"Per client, uses of /list and /whois that can be made in a burst." default:"5"`
+	EditWindow      time.Duration `long:"edit-window" description:"How long after sending a message it can be corrected with /edit, 0 to disable." default:"30s"`
+	RejoinWindow    time.Duration `long:"rejoin-window" description:"How long to hold back the leave when a connection drops, so a quick reconnect isn't announced. 0 to announce right away." default:"10s"`
+	MaxClients      int           `long:"max-clients" description:"Clients that may be connected at once, 0 for no limit. Ops can always get in."`
+	MaxRenames      int           `long:"max-renames" description:"Per client, name changes allowed in a session, 0 for no limit. Ops are exempt."`
+
+	VersionLength int `long:"version-length" description:"Characters of a client's version shown in /whois to non-ops." default:"100"`
+	MaxNameLength int `long:"max-name-length" description:"Longest name a user can have." default:"32"`
 }
 
 var logLevels = []log.Level{
@@ -33,7 +95,10 @@ func main() {
 		if p == nil {
 			fmt.Print(err)
 		}
-		return
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			return
+		}
+		os.Exit(1)
 	}
 
 	// Figure out the log level
@@ -45,15 +110,107 @@ func main() {
 	logLevel := logLevels[numVerbose]
 	logger = golog.New(os.Stderr, logLevel)
 
-	privateKey, err := ioutil.ReadFile(options.Identity)
+	config, err := loadConfig(parser, &options)
+	if err != nil {
+		logger.Errorf("Failed to load config: %v", err)
+		os.Exit(1)
+	}
+	if config.HistoryLen < 1 {
+		logger.Errorf("History length must be at least 1, got %d.", config.HistoryLen)
+		os.Exit(1)
+	}
+	if config.MaxNameLength < 1 {
+		logger.Errorf("Max name length must be at least 1, got %d.", config.MaxNameLength)
+		os.Exit(1)
+	}
+	if config.MentionTTL < 0 {
+		logger.Errorf("Mention TTL can't be negative, got %s.", time.Duration(config.MentionTTL))
+		os.Exit(1)
+	}
+	for name := range config.Cooldowns {
+		if _, ok := commands[name]; !ok {
+			logger.Errorf("Cooldown for unknown command: %s", name)
+			os.Exit(1)
+		}
+	}
+	if config.IdleTimeout > 0 && config.AwayAfter >= config.IdleTimeout {
+		logger.Errorf("The idle timeout (%s) must be longer than the away threshold (%s).",
+			time.Duration(config.IdleTimeout), time.Duration(config.AwayAfter))
+		os.Exit(1)
+	}
+
+	privateKey, err := ioutil.ReadFile(config.Identity)
 	if err != nil {
 		logger.Errorf("Failed to load identity: %v", err)
-		return
+		os.Exit(1)
 	}
 
 	server, err := NewServer(privateKey)
 	if err != nil {
 		logger.Errorf("Failed to create server: %v", err)
+		os.Exit(1)
+	}
+	server.SilenceDefault = time.Duration(config.SilenceDefault)
+	server.SilencePublic = config.SilencePublic
+	server.PersistOps = config.PersistOps
+	server.PersistMotd = config.PersistMotd
+	server.WSToken = config.WSToken
+	server.WSOrigins = config.WSOrigins
+	server.RoomName = config.Name
+	server.RoomPrompt = config.RoomPrompt
+	server.Greeting = config.Greeting
+	server.Throttle.Attempts = config.LoginAttempts
+	server.Throttle.Lockout = time.Duration(config.LoginLockout)
+	server.SetHistoryLimits(config.HistoryLen, config.HistoryBytes)
+	server.MessageInterval = time.Duration(config.MessageInterval)
+	server.MessageBurst = config.MessageBurst
+	server.NickInterval = time.Duration(config.NickInterval)
+	server.NickBurst = config.NickBurst
+	server.QueryInterval = time.Duration(config.QueryInterval)
+	server.QueryBurst = config.QueryBurst
+	server.MaxRenames = config.MaxRenames
+	server.MaxClients = config.MaxClients
+	server.RejoinWindow = time.Duration(config.RejoinWindow)
+	server.EditWindow = time.Duration(config.EditWindow)
+	server.VersionLength = config.VersionLength
+	server.MaxNameLength = config.MaxNameLength
+	server.AwayAfter = time.Duration(config.AwayAfter)
+	server.IdleTimeout = time.Duration(config.IdleTimeout)
+	server.Keepalive = time.Duration(config.Keepalive)
+	server.JanitorInterval = time.Duration(config.JanitorInterval)
+	server.MuteNoticesDefault = time.Duration(config.MuteNotices)
+	server.SetMentionTTL(time.Duration(config.MentionTTL))
+	server.HandshakeTimeout = time.Duration(config.HandshakeTimeout)
+	server.CoalesceWindow = time.Duration(config.CoalesceWindow)
+	server.CoalesceMax = config.CoalesceMax
+	server.Cooldowns = map[string]time.Duration{}
+	for name, cooldown := range config.Cooldowns {
+		server.Cooldowns[commands[name].Name] = time.Duration(cooldown)
+	}
+
+	err = server.Configure(config)
+	if err != nil {
+		logger.Errorf("Failed to configure server: %v", err)
+		os.Exit(1)
+	}
+	if config.OnEmpty != "" {
+		onEmpty, err := server.OnEmpty(config.OnEmpty)
+		if err != nil {
+			logger.Errorf("Invalid --on-empty: %v", err)
+			os.Exit(1)
+		}
+		server.Subscribe(onEmpty)
+	}
+	for _, name := range config.Bots {
+		newBot, ok := Bots[name]
+		if !ok {
+			logger.Errorf("No such bot: %s", name)
+			os.Exit(1)
+		}
+		server.AddHandler(newBot(server))
+	}
+	if options.Check {
+		fmt.Println("Config OK.")
 		return
 	}
 
@@ -61,17 +218,229 @@ func main() {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
 
-	err = server.Start(options.Bind)
+	// Reload the config on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	err = server.Start(config.Bind)
 	if err != nil {
 		logger.Errorf("Failed to start server: %v", err)
-		return
+		os.Exit(1)
+	}
+	if config.TelnetAddr != "" {
+		err = server.StartTelnet(config.TelnetAddr)
+		if err != nil {
+			logger.Errorf("Failed to start telnet: %v", err)
+			os.Exit(1)
+		}
+	}
+	if config.WSAddr != "" {
+		err = server.StartWebSocket(config.WSAddr)
+		if err != nil {
+			logger.Errorf("Failed to start WebSockets: %v", err)
+			os.Exit(1)
+		}
 	}
+	if config.HTTPAddr != "" {
+		err = server.StartHTTP(config.HTTPAddr)
+		if err != nil {
+			logger.Errorf("Failed to start HTTP: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	for {
+		select {
+		case <-hup:
+			logger.Infof("Hangup signal detected, reloading config and files.")
+			config, err := loadConfig(parser, &options)
+			if err == nil {
+				err = server.Configure(config)
+			}
+			if err != nil {
+				logger.Errorf("Failed to reload config: %v", err)
+			}
+		case <-sig: // Wait for ^C signal
+			logger.Warningf("Interrupt signal detected, shutting down.")
+			server.Stop()
+			return
+		}
+	}
+}
 
+// loadConfig reads the config file named by options, if any, and overlays
+// the command line options. Flags given on the command line win over the
+// file, and defaults only fill in what the file leaves unset.
+func loadConfig(parser *flags.Parser, options *Options) (*Config, error) {
+	config := &Config{}
+	if options.Config != "" {
+		var err error
+		config, err = LoadConfig(options.Config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Options filled in from their defaults count as set too, so only
+	// those given on the command line win over the file.
+	isSet := func(name string) bool {
+		option := parser.FindOptionByLongName(name)
+		return option.IsSet() && !option.IsSetDefault()
+	}
+
+	if isSet("bind") || !config.has("bind") {
+		config.Bind = options.Bind
+	}
+	if isSet("telnet-addr") || !config.has("telnet_addr") {
+		config.TelnetAddr = options.TelnetAddr
+	}
+	if isSet("ws-addr") || !config.has("ws_addr") {
+		config.WSAddr = options.WSAddr
+	}
+	if isSet("http-addr") || !config.has("http_addr") {
+		config.HTTPAddr = options.HTTPAddr
+	}
+	if isSet("ws-token") || !config.has("ws_token") {
+		config.WSToken = options.WSToken
+	}
+	if isSet("ws-origin") || !config.has("ws_origins") {
+		config.WSOrigins = options.WSOrigin
+	}
+	if isSet("on-empty") || !config.has("on_empty") {
+		config.OnEmpty = options.OnEmpty
+	}
+	if isSet("identity") || !config.has("identity") {
+		config.Identity = options.Identity
+	}
+	if isSet("motd") || !config.has("motd") {
+		config.Motd = options.Motd
+	}
+	if isSet("banner") || !config.has("banner") {
+		config.Banner = options.Banner
+	}
+	if isSet("banner-art") || !config.has("banner_art") {
+		config.BannerArt = options.BannerArt
+	}
+	if isSet("name") || !config.has("name") {
+		config.Name = options.Name
+	}
+	if isSet("greeting") || !config.has("greeting") {
+		config.Greeting = options.Greeting
+	}
+	if isSet("opfile") || !config.has("opfile") {
+		config.OpFile = options.OpFile
+	}
+	if isSet("banfile") || !config.has("banfile") {
+		config.BanFile = options.BanFile
+	}
+	if isSet("badgefile") || !config.has("badgefile") {
+		config.BadgeFile = options.BadgeFile
+	}
+	if isSet("pinfile") || !config.has("pinfile") {
+		config.PinFile = options.PinFile
+	}
+	if isSet("lang") || !config.has("lang") {
+		config.Lang = options.Lang
+	}
+	if isSet("responders") || !config.has("responders") {
+		config.Responders = options.Responders
+	}
+	if isSet("silence-default") || !config.has("silence_default") {
+		config.SilenceDefault = Duration(options.SilenceDefault)
+	}
+	if isSet("login-attempts") || !config.has("login_attempts") {
+		config.LoginAttempts = options.LoginAttempts
+	}
+	if isSet("login-lockout") || !config.has("login_lockout") {
+		config.LoginLockout = Duration(options.LoginLockout)
+	}
+	if isSet("away-after") || !config.has("away_after") {
+		config.AwayAfter = Duration(options.AwayAfter)
+	}
+	if isSet("idletimeout") || !config.has("idle_timeout") {
+		config.IdleTimeout = Duration(options.IdleTimeout)
+	}
+	if isSet("janitor-interval") || !config.has("janitor_interval") {
+		config.JanitorInterval = Duration(options.JanitorInterval)
+	}
+	if isSet("mute-notices-default") || !config.has("mute_notices_default") {
+		config.MuteNotices = Duration(options.MuteNotices)
+	}
+	if isSet("mention-ttl") || !config.has("mention_ttl") {
+		config.MentionTTL = Duration(options.MentionTTL)
+	}
+	if isSet("handshake-timeout") || !config.has("handshake_timeout") {
+		config.HandshakeTimeout = Duration(options.HandshakeTimeout)
+	}
+	if isSet("coalesce-window") || !config.has("coalesce_window") {
+		config.CoalesceWindow = Duration(options.CoalesceWindow)
+	}
+	if isSet("coalesce-max") || !config.has("coalesce_max") {
+		config.CoalesceMax = options.CoalesceMax
+	}
+	if isSet("keepalive") || !config.has("keepalive") {
+		config.Keepalive = Duration(options.Keepalive)
+	}
+	if isSet("history-len") || !config.has("history_len") {
+		config.HistoryLen = options.HistoryLen
+	}
+	if isSet("history-bytes") || !config.has("history_bytes") {
+		config.HistoryBytes = options.HistoryBytes
+	}
+	if isSet("message-interval") || !config.has("message_interval") {
+		config.MessageInterval = Duration(options.MessageInterval)
+	}
+	if isSet("message-burst") || !config.has("message_burst") {
+		config.MessageBurst = options.MessageBurst
+	}
+	if isSet("nick-interval") || !config.has("nick_interval") {
+		config.NickInterval = Duration(options.NickInterval)
+	}
+	if isSet("nick-burst") || !config.has("nick_burst") {
+		config.NickBurst = options.NickBurst
+	}
+	if isSet("query-interval") || !config.has("query_interval") {
+		config.QueryInterval = Duration(options.QueryInterval)
+	}
+	if isSet("query-burst") || !config.has("query_burst") {
+		config.QueryBurst = options.QueryBurst
+	}
+	if isSet("edit-window") || !config.has("edit_window") {
+		config.EditWindow = Duration(options.EditWindow)
+	}
+	if isSet("rejoin-window") || !config.has("rejoin_window") {
+		config.RejoinWindow = Duration(options.RejoinWindow)
+	}
+	if isSet("max-clients") || !config.has("max_clients") {
+		config.MaxClients = options.MaxClients
+	}
+	if isSet("max-renames") || !config.has("max_renames") {
+		config.MaxRenames = options.MaxRenames
+	}
+	if isSet("version-length") || !config.has("version_length") {
+		config.VersionLength = options.VersionLength
+	}
+	if isSet("max-name-length") || !config.has("max_name_length") {
+		config.MaxNameLength = options.MaxNameLength
+	}
+	if isSet("bot") || !config.has("bots") {
+		config.Bots = options.Bot
+	}
+	if options.SilencePublic {
+		config.SilencePublic = true
+	}
+	if options.PersistOps {
+		config.PersistOps = true
+	}
+	if options.PersistMotd {
+		config.PersistMotd = true
+	}
+	if options.RoomPrompt {
+		config.RoomPrompt = true
+	}
 	if options.Admin != "" {
-		server.Op(options.Admin)
+		config.Admins = append(config.Admins, options.Admin)
 	}
 
-	<-sig // Wait for ^C signal
-	logger.Warningf("Interrupt signal detected, shutting down.")
-	server.Stop()
+	return config, nil
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh-chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	data := `{"handshake_timeout": "0s", "janitor_interval": "0s", "history_len": 5, "bind": ":2022"}`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(args ...string) *Config {
+		options := Options{}
+		parser := flags.NewParser(&options, flags.None)
+		if _, err := parser.ParseArgs(append([]string{"--config", path}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		config, err := loadConfig(parser, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+
+	// Zero values in the file override the defaults, and keys it leaves
+	// out get them.
+	config := load()
+	if config.HandshakeTimeout != 0 || config.JanitorInterval != 0 {
+		t.Errorf("Zero durations from the file were overridden: %s, %s",
+			time.Duration(config.HandshakeTimeout), time.Duration(config.JanitorInterval))
+	}
+	if config.HistoryLen != 5 || config.Bind != ":2022" {
+		t.Errorf("Got history length %d and bind %q from the file", config.HistoryLen, config.Bind)
+	}
+	if config.MessageBurst != 5 || time.Duration(config.EditWindow) != 30*time.Second {
+		t.Errorf("Defaults weren't filled in: %d, %s", config.MessageBurst, time.Duration(config.EditWindow))
+	}
+
+	// Flags given on the command line win over the file.
+	config = load("--history-len=7", "--handshake-timeout=5s")
+	if config.HistoryLen != 7 || time.Duration(config.HandshakeTimeout) != 5*time.Second {
+		t.Errorf("Flags didn't override the file: %d, %s", config.HistoryLen, time.Duration(config.HandshakeTimeout))
+	}
+}
@@ -0,0 +1,1008 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Command is a chat command like /nick, along with how many arguments it
+// takes.
+type Command struct {
+	Name    string   // including the slash
+	Aliases []string // other names it can be run by
+	Usage   string   // arguments, like "$NAME [$DURATION]"
+	Help    string   // one line description
+	Op      bool     // only ops may run it
+	Query   bool     // looks things up, so non-ops are rate limited in using it
+
+	// Cooldown is how long a non-op must wait between uses of the command,
+	// unless the server overrides it.
+	Cooldown time.Duration
+
+	// MinArgs and MaxArgs bound the number of arguments, which are separated
+	// by spaces. With Rest, the last argument is the remainder of the line
+	// instead, spaces and all, for commands that take free text.
+	MinArgs int
+	MaxArgs int
+	Rest    bool
+
+	// Details, if set, returns more about the command for "/help $COMMAND".
+	Details func(c *Client) string
+
+	Handler func(c *Client, args []string)
+}
+
+// Commands is a set of commands, looked up by name.
+type Commands map[string]*Command
+
+// Add registers cmd under its name and aliases, replacing any command with
+// the same name.
+func (cmds Commands) Add(cmd *Command) {
+	cmds[cmd.Name] = cmd
+	for _, alias := range cmd.Aliases {
+		cmds[alias] = cmd
+	}
+}
+
+// Run parses line, checks the caller may run the command with the arguments
+// given, and runs it. Problems are reported back to the client.
+func (cmds Commands) Run(c *Client, line string) {
+	name := line
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name = line[:i]
+	}
+	cmd, ok := cmds[name]
+	if !ok {
+		c.tell("invalid_command", line)
+		return
+	}
+	if cmd.Op && !c.Server.IsOp(c) {
+		c.tell("not_op")
+		return
+	}
+	if cmd.Query && !c.Server.IsOp(c) && !c.queryLimiter.Allow() {
+		c.tell("query_too_fast")
+		return
+	}
+
+	args := splitArgs(line[len(name):], cmd.MaxArgs, cmd.Rest)
+	if len(args) < cmd.MinArgs {
+		c.tell("missing_args", cmd.missing(len(args)), cmd.usage(name))
+		return
+	}
+	if len(args) > cmd.MaxArgs {
+		c.tell("too_many_args", name, cmd.usage(name))
+		return
+	}
+	if wait := c.cooldownWait(cmd); wait > 0 {
+		c.tell("cooldown", cmd.Name, int(math.Ceil(wait.Seconds())))
+		return
+	}
+	cmd.Handler(c, args)
+}
+
+// Help returns the help listing, sorted by name. Op commands are only listed,
+// and marked as such, for ops.
+func (cmds Commands) Help(op bool, messages *Messages) []string {
+	names := []string{}
+	for name, cmd := range cmds {
+		if name != cmd.Name || (cmd.Op && !op) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"-> " + messages.Get("help_header")}
+	for _, name := range names {
+		cmd := cmds[name]
+		lines = append(lines, fmt.Sprintf("   %-26s %s", cmd.usage(name), cmd.summary(messages)))
+	}
+	return lines
+}
+
+// List returns a line for each name a command can be run by, sorted, for
+// tools to parse: the name, the least and most arguments it takes, and its
+// flags separated by commas, or "-" for none. The flags are "op" for op
+// commands, "rest" if the last argument is the rest of the line, and
+// "alias=NAME" for an alias of NAME. Op commands are only listed for ops.
+func (cmds Commands) List(op bool) []string {
+	names := []string{}
+	for name, cmd := range cmds {
+		if !cmd.Op || op {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	lines := make([]string, len(names))
+	for i, name := range names {
+		cmd := cmds[name]
+		flags := []string{}
+		if cmd.Op {
+			flags = append(flags, "op")
+		}
+		if cmd.Rest {
+			flags = append(flags, "rest")
+		}
+		if name != cmd.Name {
+			flags = append(flags, "alias="+cmd.Name)
+		}
+		if len(flags) == 0 {
+			flags = append(flags, "-")
+		}
+		lines[i] = fmt.Sprintf("%s %d %d %s", name, cmd.MinArgs, cmd.MaxArgs, strings.Join(flags, ","))
+	}
+	return lines
+}
+
+// OpNames returns the names of the op commands, sorted.
+func (cmds Commands) OpNames() []string {
+	names := []string{}
+	for name, cmd := range cmds {
+		if name == cmd.Name && cmd.Op {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HelpFor returns the help for the command named name, with or without the
+// slash, for c. Op commands are only described to ops.
+func (cmds Commands) HelpFor(c *Client, name string) ([]string, bool) {
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	cmd, ok := cmds[name]
+	if !ok || (cmd.Op && !c.Server.IsOp(c)) {
+		return nil, false
+	}
+	lines := []string{fmt.Sprintf("-> %s: %s", cmd.usage(cmd.Name), cmd.summary(c.Server.messages))}
+	if cmd.Details != nil {
+		lines = append(lines, "   "+cmd.Details(c))
+	}
+	return lines, true
+}
+
+// summary is the command's help, from messages, with its aliases, and
+// marked if it's an op command.
+func (cmd *Command) summary(messages *Messages) string {
+	help := messages.Get("help " + cmd.Name)
+	if len(cmd.Aliases) > 0 {
+		help += fmt.Sprintf(messages.Get("help_aliases"), strings.Join(cmd.Aliases, ", "))
+	}
+	if cmd.Op {
+		help += messages.Get("help_op")
+	}
+	return help
+}
+
+// usage returns how to run the command as name.
+func (cmd *Command) usage(name string) string {
+	if cmd.Usage == "" {
+		return name
+	}
+	return name + " " + cmd.Usage
+}
+
+// missing returns the name of the nth argument from the usage.
+func (cmd *Command) missing(n int) string {
+	fields := strings.Fields(cmd.Usage)
+	if n >= len(fields) {
+		return "arguments"
+	}
+	return strings.Trim(fields[n], "[]")
+}
+
+// splitArgs splits s into arguments on spaces. With rest, it stops splitting
+// after max-1 arguments and keeps the remainder, trimmed, as the last one.
+func splitArgs(s string, max int, rest bool) []string {
+	if !rest {
+		return strings.Fields(s)
+	}
+
+	args := []string{}
+	for len(args) < max-1 {
+		s = strings.TrimLeft(s, " \t")
+		i := strings.IndexAny(s, " \t")
+		if i < 0 {
+			break
+		}
+		args = append(args, s[:i])
+		s = s[i:]
+	}
+	if s = strings.TrimSpace(s); s != "" {
+		args = append(args, s)
+	}
+	return args
+}
+
+// commands are the commands available in the chat.
+var commands = Commands{}
+
+func init() {
+	commands.Add(&Command{
+		Name:    "/about",
+		Help:    "About ssh-chat.",
+		Handler: func(c *Client, args []string) { c.Page(strings.Split(ABOUT_TEXT, "\n")) },
+	})
+	commands.Add(&Command{
+		Name: "/afk", Usage: "[$REASON]", MaxArgs: 1, Rest: true,
+		Help: "Mark yourself away, with \"afk\" if there's no reason.",
+		Handler: func(c *Client, args []string) {
+			reason := "afk"
+			if len(args) > 0 {
+				reason = args[0]
+			}
+			c.setAway(reason)
+		},
+	})
+	commands.Add(&Command{
+		Name: "/again",
+		Help: "Send your last message again.",
+		Handler: func(c *Client, args []string) {
+			if len(c.sent) == 0 {
+				c.tell("nothing_again")
+				return
+			}
+			c.say(c.sent[len(c.sent)-1], true)
+		},
+	})
+	commands.Add(&Command{
+		Name: "/away", Usage: "[$REASON]", MaxArgs: 1, Rest: true,
+		Help: "Mark yourself away, or back without a reason.",
+		Handler: func(c *Client, args []string) {
+			if len(args) == 0 {
+				if c.IsAway() {
+					c.Back()
+				} else {
+					c.tell("missing_reason")
+				}
+				return
+			}
+			c.setAway(args[0])
+		},
+	})
+	commands.Add(&Command{
+		Name: "/back",
+		Help: "Clear your away status.",
+		Handler: func(c *Client, args []string) {
+			if !c.IsAway() {
+				c.tell("not_away")
+				return
+			}
+			c.Back()
+		},
+	})
+	commands.Add(&Command{
+		Name: "/commands",
+		Help: "List the commands for tools, one per line: the name, the least and most arguments, and flags.",
+		Handler: func(c *Client, args []string) {
+			c.WriteLines(commands.List(c.Server.IsOp(c)))
+		},
+	})
+	commands.Add(&Command{
+		Name: "/edit", Usage: "$TEXT", MinArgs: 1, MaxArgs: 1, Rest: true,
+		Help: "Correct your last message, shortly after sending it.",
+		Handler: func(c *Client, args []string) {
+			window := c.Server.EditWindow
+			if window <= 0 {
+				c.tell("editing_off")
+				return
+			}
+			if c.lastMsg == "" || c.Server.Clock().Sub(c.lastMsgAt) > window {
+				c.tell("nothing_to_edit", window)
+				return
+			}
+			msg := NewEditMsg(c, c.Server.Text("edited", args[0], truncate(c.lastMsg, 40)))
+			if !c.allowMessage(msg) {
+				return
+			}
+			c.lastMsg = args[0]
+			if len(c.sent) > 0 {
+				c.sent[len(c.sent)-1] = args[0]
+			}
+			c.Server.BroadcastMessage(msg, nil)
+		},
+	})
+	commands.Add(&Command{
+		Name: "/exit", Usage: "[$REASON]", MaxArgs: 1, Rest: true,
+		Help: "Leave the chat.",
+		Handler: func(c *Client, args []string) {
+			reason := ""
+			if len(args) > 0 && !c.IsSilenced() {
+				// It's announced to everyone, so it's held to what a
+				// ban reason is. Silenced users leave without one.
+				reason = truncate(printable(RE_ESCAPE.ReplaceAllString(args[0], "")), MAX_LEAVE_REASON_LENGTH)
+			}
+			c.Server.Leave(c, reason)
+			c.Conn.Close()
+		},
+	})
+	commands.Add(&Command{
+		Name: "/help", Usage: "[$COMMAND]", MaxArgs: 1,
+		Help: "Show this help, or more about one command.",
+		Handler: func(c *Client, args []string) {
+			if len(args) == 0 {
+				c.Page(commands.Help(c.Server.IsOp(c), c.Server.messages))
+				return
+			}
+			lines, ok := commands.HelpFor(c, args[0])
+			if !ok {
+				c.tell("no_such_command", args[0])
+				return
+			}
+			c.Page(lines)
+		},
+	})
+	commands.Add(&Command{
+		Name: "/last", Usage: "[$NUM]", MaxArgs: 1,
+		Help: "Show recent messages.",
+		Handler: func(c *Client, args []string) {
+			num := 10
+			if len(args) > 0 {
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n < 1 {
+					c.tell("invalid_number", args[0])
+					return
+				}
+				num = n
+			}
+			max := c.Server.history.Cap()
+			if num > max {
+				c.tell("history_cap", max)
+				return
+			}
+			for _, entry := range c.Server.history.Entries(num) {
+				c.deliver(entry.String())
+			}
+		},
+	})
+	commands.Add(&Command{
+		Name: "/list", Query: true,
+		Help: "List who is connected, marking who is away.",
+		Handler: func(c *Client, args []string) {
+			names := []string{}
+			for _, client := range c.Server.Clients() {
+				if client.IsAway() {
+					names = append(names, c.Server.Text("list_away", client.Name))
+				} else {
+					names = append(names, client.Name)
+				}
+			}
+			c.tell("list", len(names), strings.Join(names, ", "))
+		},
+	})
+	commands.Add(&Command{
+		Name: "/me", Usage: "$ACTION", MaxArgs: 1, Rest: true,
+		Help: "Send an action, like \"/me waves\".",
+		Handler: func(c *Client, args []string) {
+			if len(args) == 0 {
+				return
+			}
+			msg := NewEmoteMsg(c, " "+args[0])
+			if !c.allowMessage(msg) {
+				return
+			}
+			if c.IsAway() {
+				c.Back()
+			}
+			c.Server.BroadcastMessage(msg, nil)
+		},
+	})
+	commands.Add(&Command{
+		Name: "/mentions",
+		Help: "Show the mentions you missed while away.",
+		Handler: func(c *Client, args []string) {
+			if !c.sendMentions() {
+				c.tell("no_mentions")
+			}
+		},
+	})
+	commands.Add(&Command{
+		Name: "/motd",
+		Help: "Show the message of the day.",
+		Handler: func(c *Client, args []string) {
+			motd := c.Server.Motd()
+			if motd == "" {
+				c.tell("no_motd")
+				return
+			}
+			c.Page(c.Server.motdLines(c, motd))
+		},
+	})
+	commands.Add(&Command{
+		Name: "/mutenotices", Usage: "[$DURATION|off]", MaxArgs: 1,
+		Help: "Hide announcements and join and leave notices for a while, but not chat.",
+		Handler: func(c *Client, args []string) {
+			duration := c.Server.MuteNoticesDefault
+			if len(args) > 0 {
+				if args[0] == "off" {
+					c.MuteNotices(time.Time{})
+					c.tell("notices_shown")
+					return
+				}
+				parsedDuration, err := time.ParseDuration(args[0])
+				if err != nil || parsedDuration <= 0 {
+					c.tell("invalid_duration", args[0])
+					return
+				}
+				duration = parsedDuration
+			}
+			c.MuteNotices(c.Server.Clock().Add(duration))
+			c.tell("notices_hidden", duration)
+		},
+	})
+	commands.Add(&Command{
+		Name: "/nick", Aliases: []string{"/rename"}, Usage: "$NAME", MaxArgs: 1,
+		Help:    "Change your name.",
+		Details: nameRules,
+		Handler: func(c *Client, args []string) {
+			if len(args) == 0 {
+				c.SysMsg("%s", nameRules(c))
+				return
+			}
+			if c.guest {
+				c.tell("guest_rename")
+				return
+			}
+			if max := c.Server.MaxRenames; max > 0 && c.renameCount >= max && !c.Server.IsOp(c) {
+				c.tell("too_many_renames")
+				return
+			}
+			if !c.nickLimiter.Allow() {
+				c.tell("rename_too_fast")
+				return
+			}
+			c.Server.Rename(c, args[0])
+		},
+	})
+	commands.Add(&Command{
+		Name: "/perms",
+		Help: "Show what you're allowed to do.",
+		Handler: func(c *Client, args []string) {
+			ops := strings.Join(commands.OpNames(), ", ")
+			switch {
+			case c.Server.IsOp(c):
+				c.tell("perms_op", ops)
+			case c.guest:
+				c.tell("perms_guest")
+				c.tell("perms_op_only", ops)
+			default:
+				c.tell("perms_user", ops)
+			}
+		},
+	})
+	commands.Add(&Command{
+		Name: "/ping", Cooldown: PING_COOLDOWN,
+		Help: "Check the connection and server time.",
+		Handler: func(c *Client, args []string) {
+			c.tell("pong", c.Server.Clock().UTC().Format(time.RFC1123))
+		},
+	})
+	commands.Add(&Command{
+		Name: "/pinned",
+		Help: "Show the pinned message.",
+		Handler: func(c *Client, args []string) {
+			pin := c.Server.Pin()
+			if pin == "" {
+				c.tell("no_pin")
+				return
+			}
+			c.Page(c.Server.pinLines(c, pin))
+		},
+	})
+	commands.Add(&Command{
+		Name: "/quiet", Usage: "[on|off]", MaxArgs: 1,
+		Help: "Hide join and leave notices.",
+		Handler: func(c *Client, args []string) {
+			if len(args) > 0 {
+				if args[0] != "on" && args[0] != "off" {
+					c.tell("invalid_on_off", args[0])
+					return
+				}
+				c.HidePresence(args[0] == "on")
+			}
+			if c.PresenceHidden() {
+				c.tell("quiet_on")
+			} else {
+				c.tell("quiet_off")
+			}
+		},
+	})
+	commands.Add(&Command{
+		Name: "/search", Usage: "$TERM", MinArgs: 1, MaxArgs: 1, Rest: true,
+		Help: "Search recent messages.",
+		Handler: func(c *Client, args []string) {
+			term := args[0]
+			results := c.Server.history.Search(term)
+			if len(results) == 0 {
+				c.tell("no_matches", term)
+				return
+			}
+			more := len(results) - SEARCH_MAX_RESULTS
+			if more > 0 {
+				results = results[more:]
+			}
+			for _, entry := range results {
+				c.deliver(entry.String())
+			}
+			if more > 0 {
+				c.tell("more_matches", more)
+			}
+		},
+	})
+	commands.Add(&Command{
+		Name: "/set", Usage: "[$OPTION [$VALUE]]", MaxArgs: 2,
+		Help: "Show or change your settings.",
+		Handler: func(c *Client, args []string) {
+			if len(args) == 0 {
+				c.tell("settings", c.Theme().Name, onOff(c.Compact()))
+				return
+			}
+			switch args[0] {
+			case "theme":
+				if len(args) < 2 {
+					c.tell("themes", strings.Join(ThemeNames(), ", "))
+					return
+				}
+				theme := FindTheme(args[1])
+				if theme == nil {
+					c.tell("no_such_theme", args[1])
+					return
+				}
+				c.SetTheme(theme)
+				c.tell("set_theme", theme.Name)
+			case "color":
+				if len(args) < 2 || (args[1] != "on" && args[1] != "off") {
+					c.tell("missing_color")
+					return
+				}
+				if args[1] == "off" {
+					c.SetTheme(MonochromeTheme)
+				} else if c.Theme() == MonochromeTheme {
+					c.SetTheme(DefaultTheme)
+				}
+				c.tell("set_color", args[1])
+			case "compact":
+				if len(args) < 2 || (args[1] != "on" && args[1] != "off") {
+					c.tell("missing_compact")
+					return
+				}
+				c.SetCompact(args[1] == "on")
+				c.tell("set_compact", onOff(args[1] == "on"))
+			default:
+				c.tell("no_such_option", args[0])
+			}
+		},
+	})
+	commands.Add(&Command{
+		Name: "/whois", Usage: "[$NAME]", MaxArgs: 1, Query: true,
+		Help: "Show who a name belongs to, or who you are.",
+		Handler: func(c *Client, args []string) {
+			if len(args) == 0 || args[0] == c.Name {
+				// Everything ops could see about you, including your IP.
+				info := c.Server.Text("whois_self",
+					c.Name, c.Fingerprint(), c.RemoteIP(), c.Software(), c.Version(),
+					c.connected.UTC().Format(time.RFC1123), c.Idle().Round(time.Second))
+				if c.Server.IsOp(c) {
+					info += c.Server.Text("whois_op")
+				}
+				c.SysMsg("%s", info)
+				return
+			}
+			client := c.Server.Who(args[0])
+			if client == nil {
+				c.tell("no_such_name", args[0])
+				return
+			}
+			// Ops also see the whole version string, everyone else just a
+			// display-sized software name.
+			version := client.Software()
+			if c.Server.IsOp(c) {
+				version = fmt.Sprintf("%s (%s)", version, client.Version())
+			} else {
+				version = truncate(version, c.Server.VersionLength)
+			}
+			info := c.Server.Text("whois", client.Name, client.Fingerprint(), version)
+			if c.Server.IsOp(client) {
+				info += c.Server.Text("whois_op")
+			}
+			if away := client.AwayReason(); away != "" {
+				info += c.Server.Text("whois_away", away)
+			}
+			c.SysMsg("%s", info)
+		},
+	})
+
+	// Op commands.
+	commands.Add(&Command{
+		Name: "/appendmotd", Usage: "$TEXT", Op: true, MinArgs: 1, MaxArgs: 1, Rest: true,
+		Help:    "Add a line to the MOTD.",
+		Handler: func(c *Client, args []string) { editMotd(c, args[0], true) },
+	})
+	commands.Add(&Command{
+		Name: "/badge", Usage: "$NAME $BADGE", Op: true, MinArgs: 2, MaxArgs: 2,
+		Help:    "Show a badge before a user's name, like [VIP].",
+		Handler: func(c *Client, args []string) { setBadge(c, args[0], args[1]) },
+	})
+	commands.Add(&Command{
+		Name: "/ban", Usage: "$NAME [$REASON]", Op: true, MinArgs: 1, MaxArgs: 2, Rest: true,
+		Help: "Ban a user by their key, telling them why.",
+		Handler: func(c *Client, args []string) {
+			client := c.Server.Who(args[0])
+			if client == nil {
+				c.tell("no_such_name", args[0])
+				return
+			}
+			fingerprint := client.Fingerprint()
+			if c.Server.isLastOp(fingerprint, false) {
+				c.tell("last_op", client.Name)
+				return
+			}
+			reason := ""
+			if len(args) > 1 {
+				reason = strings.TrimRight(args[1], ".")
+			}
+			c.Server.Ban(fingerprint, nil, reason)
+			if ban, banned := c.Server.lookupBan(fingerprint); banned && ban.Reason != "" {
+				logger.Infof("%s banned %s (%s): %s", c.Name, client.Name, fingerprint, ban.Reason)
+				client.SysWrite("%s", c.Server.Text("banned_by_reason", c.Name, ban.Reason))
+			} else {
+				logger.Infof("%s banned %s (%s)", c.Name, client.Name, fingerprint)
+				client.SysWrite("%s", c.Server.Text("banned_by", c.Name))
+			}
+			client.Conn.Close()
+			c.Server.Broadcast(c.Server.Text("banned_notice", args[0], c.Name), nil)
+		},
+	})
+	commands.Add(&Command{
+		Name: "/banlist", Op: true,
+		Help: "List the banned keys, with why they were banned.",
+		Handler: func(c *Client, args []string) {
+			bans := c.Server.Bans()
+			lines := []string{c.sysLine("%s", c.Server.Text("banlist_header", len(bans)))}
+			for _, ban := range bans {
+				line := ban.Fingerprint
+				if ban.Until != nil {
+					line += c.Server.Text("banlist_until", ban.Until.UTC().Format(time.RFC1123))
+				}
+				if ban.Reason != "" {
+					line += ": " + ban.Reason
+				}
+				lines = append(lines, c.sysLine("%s", line))
+			}
+			c.Page(lines)
+		},
+	})
+	commands.Add(&Command{
+		Name: "/clearhistory", Op: true,
+		Help: "Clear the history replayed to new users and searched by /last and /search.",
+		Handler: func(c *Client, args []string) {
+			c.Server.history.Clear()
+			logger.Infof("%s cleared the history", c.Name)
+			c.Server.Broadcast(c.Server.Text("history_cleared", c.Name), nil)
+		},
+	})
+	commands.Add(&Command{
+		Name: "/clients", Op: true,
+		Help: "List connection details for everyone.",
+		Handler: func(c *Client, args []string) {
+			clients := c.Server.Clients()
+			lines := []string{c.sysLine("%s", c.Server.Text("clients_header", len(clients)))}
+			for _, client := range clients {
+				lines = append(lines, c.sysLine("%s", c.Server.Text("clients_line",
+					client.Name, client.Fingerprint(), client.RemoteIP(), client.Version(),
+					client.connected.UTC().Format(time.RFC1123), client.Idle().Round(time.Second))))
+			}
+			c.Page(lines)
+		},
+	})
+	commands.Add(&Command{
+		Name: "/deop", Usage: "$NAME", Op: true, MinArgs: 1, MaxArgs: 1,
+		Help: "Remove a user as op.",
+		Handler: func(c *Client, args []string) {
+			client := c.Server.Who(args[0])
+			if client == nil {
+				c.tell("no_such_name", args[0])
+				return
+			}
+			fingerprint := client.Fingerprint()
+			if fingerprint == "" {
+				c.tell("no_key_op", client.Name)
+				return
+			}
+			if c.Server.isLastOp(fingerprint, true) {
+				c.tell("last_op", client.Name)
+				return
+			}
+			client.tell("removed_op", c.Name)
+			c.Server.Deop(fingerprint)
+			if err := c.Server.SaveOp(fingerprint, false); err != nil {
+				logger.Errorf("Failed to save op file: %v", err)
+				c.tell("deop_not_saved", client.Name, err)
+			}
+		},
+	})
+	commands.Add(&Command{
+		Name: "/drain", Usage: "[on|off]", Op: true, MaxArgs: 1,
+		Help: "Turn new connections away, leaving everyone connected, before a restart.",
+		Handler: func(c *Client, args []string) {
+			draining := true
+			if len(args) > 0 {
+				if args[0] != "on" && args[0] != "off" {
+					c.tell("invalid_on_off", args[0])
+					return
+				}
+				draining = args[0] == "on"
+			}
+			if draining == c.Server.Draining() {
+				if draining {
+					c.tell("already_draining")
+				} else {
+					c.tell("not_draining")
+				}
+				return
+			}
+			c.Server.SetDraining(draining)
+			if draining {
+				logger.Infof("%s started draining", c.Name)
+				c.Server.Broadcast(c.Server.Text("draining_on", c.Name), nil)
+			} else {
+				logger.Infof("%s stopped draining", c.Name)
+				c.Server.Broadcast(c.Server.Text("draining_off", c.Name), nil)
+			}
+		},
+	})
+	commands.Add(&Command{
+		Name: "/forcenick", Usage: "$NAME $NEWNAME", Op: true, MinArgs: 2, MaxArgs: 2,
+		Help:    "Rename a user who won't change their name.",
+		Details: nameRules,
+		Handler: func(c *Client, args []string) {
+			client := c.Server.Who(args[0])
+			if client == nil {
+				c.tell("no_such_name", args[0])
+				return
+			}
+			oldName := client.Name
+			newName, err := c.Server.ForceRename(client, args[1])
+			if err != nil {
+				c.SysMsg("%s", err)
+				return
+			}
+			logger.Infof("%s renamed %s (%s) to %s", c.Name, oldName, client.Identity(), newName)
+			if client != c {
+				client.tell("renamed_by", newName, c.Name)
+			}
+		},
+	})
+	commands.Add(&Command{
+		Name: "/op", Usage: "$NAME", Op: true, MinArgs: 1, MaxArgs: 1,
+		Help: "Make a user an op.",
+		Handler: func(c *Client, args []string) {
+			client := c.Server.Who(args[0])
+			if client == nil {
+				c.tell("no_such_name", args[0])
+				return
+			}
+			fingerprint := client.Fingerprint()
+			if fingerprint == "" {
+				c.tell("no_key_op", client.Name)
+				return
+			}
+			client.tell("made_op", c.Name)
+			c.Server.Op(fingerprint)
+			if err := c.Server.SaveOp(fingerprint, true); err != nil {
+				logger.Errorf("Failed to save op file: %v", err)
+				c.tell("op_not_saved", client.Name, err)
+			}
+		},
+	})
+	commands.Add(&Command{
+		Name: "/pin", Usage: "[$TEXT]", Op: true, MaxArgs: 1, Rest: true,
+		Help: "Pin a message for everyone who joins, or the last message without one.",
+		Handler: func(c *Client, args []string) {
+			text := ""
+			if len(args) > 0 {
+				text = args[0]
+			} else if last := c.Server.history.Get(1); len(last) > 0 {
+				text = last[0]
+			}
+			if strings.TrimSpace(text) == "" {
+				c.tell("nothing_to_pin")
+				return
+			}
+			setPin(c, text)
+		},
+	})
+	commands.Add(&Command{
+		Name: "/setmotd", Usage: "[$TEXT]", Op: true, MaxArgs: 1, Rest: true,
+		Help: "Replace the MOTD, \\n starts a new line. Clears it without $TEXT.",
+		Handler: func(c *Client, args []string) {
+			text := ""
+			if len(args) > 0 {
+				text = args[0]
+			}
+			editMotd(c, text, false)
+		},
+	})
+	commands.Add(&Command{
+		Name: "/silence", Usage: "$NAME [$DURATION]", Op: true, MinArgs: 1, MaxArgs: 2,
+		Help: "Stop a user from talking for a while.",
+		Handler: func(c *Client, args []string) {
+			duration := c.Server.SilenceDefault
+			if len(args) >= 2 {
+				parsedDuration, err := time.ParseDuration(args[1])
+				if err != nil {
+					c.tell("invalid_duration", args[1])
+					return
+				}
+				duration = parsedDuration
+			}
+			client := c.Server.Who(args[0])
+			if client == nil {
+				c.tell("no_such_name", args[0])
+				return
+			}
+			c.Server.Silence(client, duration)
+			client.tell("silenced_by", duration, c.Name)
+			if c.Server.SilencePublic {
+				c.Server.Broadcast(c.Server.Text("silenced_notice", client.Name, c.Name, duration), nil)
+			} else {
+				c.tell("silenced_user", client.Name, duration)
+			}
+		},
+	})
+	commands.Add(&Command{
+		Name: "/slowmode", Usage: "[$DURATION|off]", Op: true, MaxArgs: 1,
+		Help: "Limit how often everyone but ops may send a message.",
+		Handler: func(c *Client, args []string) {
+			if len(args) == 0 {
+				if interval := c.Server.SlowMode(); interval > 0 {
+					c.tell("slow_mode_on", interval)
+				} else {
+					c.tell("slow_mode_off")
+				}
+				return
+			}
+			var interval time.Duration
+			if args[0] != "off" {
+				parsedInterval, err := time.ParseDuration(args[0])
+				if err != nil || parsedInterval < 0 {
+					c.tell("invalid_duration", args[0])
+					return
+				}
+				interval = parsedInterval
+			}
+			c.Server.SetSlowMode(interval)
+			if interval > 0 {
+				c.Server.Broadcast(c.Server.Text("slow_mode_on_notice", c.Name, interval), nil)
+			} else {
+				c.Server.Broadcast(c.Server.Text("slow_mode_off_notice", c.Name), nil)
+			}
+		},
+	})
+	commands.Add(&Command{
+		Name: "/stats", Op: true,
+		Help: "Show how many have connected since the server started.",
+		Handler: func(c *Client, args []string) {
+			stats := c.Server.Stats()
+			c.tell("stats_connected", stats.Connected, stats.Peak)
+			c.tell("stats_sessions", stats.Sessions, stats.UniqueKeys)
+			if stats.Draining {
+				c.tell("stats_draining")
+			}
+		},
+	})
+	commands.Add(&Command{
+		Name: "/unbadge", Usage: "$NAME", Op: true, MinArgs: 1, MaxArgs: 1,
+		Help:    "Take away a user's badge.",
+		Handler: func(c *Client, args []string) { setBadge(c, args[0], "") },
+	})
+	commands.Add(&Command{
+		Name: "/unpin", Op: true,
+		Help: "Unpin the pinned message.",
+		Handler: func(c *Client, args []string) {
+			if c.Server.Pin() == "" {
+				c.tell("no_pin")
+				return
+			}
+			setPin(c, "")
+		},
+	})
+	commands.Add(&Command{
+		Name: "/warn", Usage: "$NAME $TEXT", Op: true, MinArgs: 2, MaxArgs: 2, Rest: true,
+		Help: "Privately warn a user, from the server.",
+		Handler: func(c *Client, args []string) {
+			client := c.Server.Who(args[0])
+			if client == nil {
+				c.tell("no_such_name", args[0])
+				return
+			}
+			logger.Infof("%s warned %s (%s): %s", c.Name, client.Name, client.Identity(), args[1])
+			client.Warn(args[1])
+			if client != c {
+				c.tell("warned", client.Name)
+			}
+		},
+	})
+}
+
+// setBadge gives the named user a badge for /badge, or takes theirs away for
+// /unbadge if badge is empty.
+func setBadge(c *Client, name string, badge string) {
+	client := c.Server.Who(name)
+	if client == nil {
+		c.tell("no_such_name", name)
+		return
+	}
+	if client.Fingerprint() == "" {
+		c.tell("guest_badge")
+		return
+	}
+	badge, err := c.Server.SetBadge(client.Fingerprint(), badge)
+	if err != nil {
+		c.tell("badge_failed", client.Name, err)
+		return
+	}
+	if err := c.Server.SaveBadges(); err != nil {
+		logger.Errorf("Failed to save badge file: %v", err)
+		c.tell("badge_not_saved", client.Name, err)
+	}
+	if badge == "" {
+		c.tell("badge_removed", client.Name)
+		return
+	}
+	c.tell("badge_given", client.Name, badge)
+}
+
+// nameRules describes the names /nick accepts.
+func nameRules(c *Client) string {
+	return c.Server.Text("name_rules", c.Server.MaxNameLength)
+}
+
+// setPin pins text for c, or unpins the message if text is empty, and tells
+// the room.
+func setPin(c *Client, text string) {
+	pin, err := c.Server.SetPin(text)
+	if err != nil {
+		c.tell("pin_failed", err)
+		return
+	}
+	if err := c.Server.SavePin(); err != nil {
+		logger.Errorf("Failed to save pin file: %v", err)
+		c.tell("pin_not_saved", err)
+	}
+	if pin == "" {
+		logger.Infof("%s unpinned the message", c.Name)
+		c.Server.Broadcast(c.Server.Text("unpinned", c.Name), nil)
+		return
+	}
+	logger.Infof("%s pinned: %s", c.Name, pin)
+	c.Server.Broadcast(c.Server.Text("pinned", c.Name), nil)
+}
+
+// editMotd changes the MOTD for /setmotd and /appendmotd, and shows the op the
+// result. Replies are written immediately so they stay in order with it.
+func editMotd(c *Client, text string, add bool) {
+	motd, err := c.Server.EditMotd(text, add)
+	if err != nil {
+		c.tell("motd_failed", err)
+		return
+	}
+	if err := c.Server.SaveMotd(); err != nil {
+		logger.Errorf("Failed to save MOTD file: %v", err)
+		c.SysWrite("%s", c.Server.Text("motd_not_saved", err))
+	}
+	if motd == "" {
+		c.SysWrite("%s", c.Server.Text("motd_cleared"))
+		return
+	}
+	c.SysWrite("%s", c.Server.Text("motd_now"))
+	c.WriteLines(strings.Split(motd, "\n"))
+}
@@ -0,0 +1,824 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		rest bool
+		want []string
+	}{
+		{"", 1, false, []string{}},
+		{" alice", 1, false, []string{"alice"}},
+		{"  alice   bob ", 1, false, []string{"alice", "bob"}},
+		{" waves  at you ", 1, true, []string{"waves  at you"}},
+		{" alice 5m extra", 2, false, []string{"alice", "5m", "extra"}},
+		{" alice being  rude", 2, true, []string{"alice", "being  rude"}},
+		{"   ", 1, true, []string{}},
+	}
+	for _, test := range tests {
+		if got := splitArgs(test.in, test.max, test.rest); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitArgs(%q, %d, %v) = %q, expected %q", test.in, test.max, test.rest, got, test.want)
+		}
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server, "alice")
+	op := newTestClient(server, "bob")
+	server.Op(op.Fingerprint())
+
+	tests := []struct {
+		client *Client
+		line   string
+		want   string
+	}{
+		{client, "/nick", "Names can be up to 32 letters, digits, and underscores."},
+		{client, "/nick carol dave", "Too many arguments to /nick, expected: /nick $NAME"},
+		{client, "/whois alice bob", "Too many arguments to /whois, expected: /whois [$NAME]"},
+		{client, "/whois   bob  ", "bob is fp-bob via FakeSSH 1.0 (operator)"},
+		{op, "/whois alice", "alice is fp-alice via FakeSSH 1.0 (SSH-2.0-FakeSSH_1.0)\x1b"},
+		{client, "/whois", "You are alice, fp-alice from 127.0.0.1 via FakeSSH 1.0 (SSH-2.0-FakeSSH_1.0)"},
+		{client, "/whois alice", "You are alice, fp-alice from 127.0.0.1"},
+		{client, "/search", "Missing $TERM from: /search $TERM"},
+		{client, "/search no such thing", "No messages matching: no such thing"},
+		{client, "/ping now", "Too many arguments to /ping, expected: /ping"},
+		{client, "/silence alice", "You're not an admin."},
+		{op, "/silence", "Missing $NAME from: /silence $NAME [$DURATION]"},
+		{op, "/silence alice 5m extra", "Too many arguments to /silence, expected: /silence $NAME [$DURATION]"},
+		{client, "/nosuchcommand", "Invalid command: /nosuchcommand"},
+	}
+	for _, test := range tests {
+		commands.Run(test.client, test.line)
+		if got := <-test.client.Msg; !strings.Contains(got, test.want) {
+			t.Errorf("%s: got %q, expected %q", test.line, got, test.want)
+		}
+	}
+
+	commands.Run(client, "/me waves  at you")
+	<-op.Msg
+	if entries := server.history.Search("** alice waves  at you"); len(entries) != 1 {
+		t.Errorf("Emote didn't get the rest of the line.")
+	}
+}
+
+func TestHelp(t *testing.T) {
+	user := strings.Join(commands.Help(false, &Messages{}), "\n")
+	op := strings.Join(commands.Help(true, &Messages{}), "\n")
+
+	if !strings.Contains(user, "/nick $NAME") || !strings.Contains(op, "/nick $NAME") {
+		t.Errorf("Help is missing /nick.")
+	}
+	if strings.Contains(user, "/ban") {
+		t.Errorf("Help for users lists op commands.")
+	}
+	if !strings.Contains(op, "/ban $NAME") || !strings.Contains(op, "(op)") {
+		t.Errorf("Help for ops is missing op commands.")
+	}
+	for name, cmd := range commands {
+		if cmd.Help == "" {
+			t.Errorf("%s has no help.", name)
+		}
+	}
+}
+
+func TestCommandList(t *testing.T) {
+	user := commands.List(false)
+	op := commands.List(true)
+
+	for _, want := range []string{"/nick 0 1 -", "/rename 0 1 alias=/nick", "/me 0 1 rest"} {
+		if !containsLine(user, want) {
+			t.Errorf("Missing %q from %q", want, user)
+		}
+	}
+	if !containsLine(op, "/ban 1 2 op,rest") {
+		t.Errorf("Missing /ban from the op list: %q", op)
+	}
+	for _, line := range user {
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			t.Fatalf("Line isn't 4 fields: %q", line)
+		}
+		if strings.HasPrefix(fields[3], "op") {
+			t.Errorf("User list has an op command: %q", line)
+		}
+	}
+}
+
+func TestNameLength(t *testing.T) {
+	server := newTestServer(t)
+	server.MaxNameLength = 16
+	server.NickInterval = 0
+	client := newTestClient(server, "alice")
+
+	commands.Run(client, "/nick "+strings.Repeat("a", 17))
+	if got := <-client.Msg; !strings.Contains(got, "-> Name too long (max 16).") {
+		t.Errorf("Got %q", got)
+	}
+	if client.Name != "alice" {
+		t.Errorf("Name too long was taken: %s", client.Name)
+	}
+
+	commands.Run(client, "/nick "+strings.Repeat("a", 16))
+	<-client.Msg
+	if client.Name != strings.Repeat("a", 16) {
+		t.Errorf("Name at the limit wasn't taken: %s", client.Name)
+	}
+
+	lines, ok := commands.HelpFor(client, "nick")
+	if help := strings.Join(lines, "\n"); !ok || !strings.Contains(help, "/nick $NAME: Change your name.") ||
+		!strings.Contains(help, "up to 16 letters, digits, and underscores") {
+		t.Errorf("Got help %q", help)
+	}
+	if _, ok := commands.HelpFor(client, "/ban"); ok {
+		t.Errorf("Op command was described to a user.")
+	}
+}
+
+func TestRenameAlias(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server, "bob")
+
+	commands.Run(client, "/rename")
+	if got := <-client.Msg; !strings.Contains(got, "Names can be up to") {
+		t.Errorf("Got %q", got)
+	}
+
+	commands.Run(client, "/rename robert")
+	if got := <-client.Msg; !strings.Contains(got, "* bob is now known as robert.") {
+		t.Errorf("Got %q", got)
+	}
+	if server.Who("robert") != client || server.Who("bob") != nil {
+		t.Errorf("Rename didn't go through the server.")
+	}
+
+	if help := strings.Join(commands.Help(false, &Messages{}), "\n"); strings.Count(help, "Change your name.") != 1 || !strings.Contains(help, "(also /rename)") {
+		t.Errorf("Help doesn't list /nick once with its alias:\n%s", help)
+	}
+}
+
+func TestSetMotd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh-chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := newTestServer(t)
+	server.PersistMotd = true
+	server.motdFile = filepath.Join(dir, "motd.txt")
+	op := newTestClient(server, "alice")
+	server.Op(op.Fingerprint())
+
+	commands.Run(op, "/setmotd Welcome!\\nBe \x1b[31mnice\x1b[0m.")
+	commands.Run(op, "/appendmotd  No \x1b]0;spam\x07spam. ")
+	want := "Welcome!\nBe nice.\nNo spam."
+	if got := server.Motd(); got != want {
+		t.Errorf("Got MOTD %q, expected %q", got, want)
+	}
+	if data, err := ioutil.ReadFile(server.motdFile); err != nil || string(data) != want+"\n" {
+		t.Errorf("Saved MOTD %q, %v", data, err)
+	}
+
+	commands.Run(op, "/appendmotd "+strings.Repeat("x", MAX_MOTD_LENGTH))
+	if got := <-op.Msg; !strings.Contains(got, "Couldn't change the MOTD") {
+		t.Errorf("Got %q", got)
+	}
+	if got := server.Motd(); got != want {
+		t.Errorf("Too long MOTD changed it to %q", got)
+	}
+
+	commands.Run(op, "/setmotd")
+	if server.Motd() != "" {
+		t.Errorf("MOTD wasn't cleared.")
+	}
+}
+
+func TestPin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh-chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := newTestServer(t)
+	server.pinFile = filepath.Join(dir, "pin.txt")
+	op := newTestClient(server, "alice")
+	server.Op(op.Fingerprint())
+	user := newTestClient(server, "bob")
+
+	commands.Run(user, "/pin hi")
+	if got := <-user.Msg; !strings.Contains(got, "You're not an admin.") {
+		t.Errorf("Got %q", got)
+	}
+	commands.Run(op, "/pin Meeting at 5.\\nBe \x1b[31mthere\x1b[0m.")
+	want := "Meeting at 5.\nBe there."
+	if got := server.Pin(); got != want {
+		t.Errorf("Got pin %q, expected %q", got, want)
+	}
+	if got := <-user.Msg; !strings.Contains(got, "alice pinned a message, see /pinned.") {
+		t.Errorf("Got %q", got)
+	}
+
+	// The pin is shown on joining, after the MOTD, and kept across restarts.
+	term := &fakeTerminal{}
+	user.term = term
+	server.Welcome(user)
+	if calls := strings.Join(term.calls, ""); !strings.Contains(calls, "Pinned:") || !strings.Contains(calls, "Be there.") {
+		t.Errorf("Pin wasn't shown on joining: %q", term.calls)
+	}
+	restarted := newTestServer(t)
+	if err := restarted.Configure(&Config{PinFile: server.pinFile}); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.Pin(); got != want {
+		t.Errorf("Pin wasn't saved, got %q", got)
+	}
+
+	server.Broadcast("bob: the last message", nil)
+	commands.Run(op, "/pin")
+	if got := server.Pin(); got != "bob: the last message" {
+		t.Errorf("Didn't pin the last message, got %q", got)
+	}
+	commands.Run(op, "/pin "+strings.Repeat("x", MAX_PIN_LENGTH+1))
+	if server.Pin() != "bob: the last message" {
+		t.Errorf("Too long pin was pinned.")
+	}
+
+	commands.Run(op, "/unpin")
+	if server.Pin() != "" {
+		t.Errorf("Pin wasn't cleared.")
+	}
+	if data, err := ioutil.ReadFile(server.pinFile); err != nil || len(data) != 0 {
+		t.Errorf("Saved pin %q, %v after unpinning", data, err)
+	}
+}
+
+func TestSlowMode(t *testing.T) {
+	server := newTestServer(t)
+	op := newTestClient(server, "alice")
+	server.Op(op.Fingerprint())
+	user := newTestClient(server, "bob")
+
+	commands.Run(op, "/slowmode 1m")
+	if got := <-user.Msg; !strings.Contains(got, "alice turned on slow mode, one message every 1m0s.") {
+		t.Errorf("Got %q", got)
+	}
+	<-op.Msg
+
+	if !user.allowMessage(NewChatMsg(user, "first")) {
+		t.Fatalf("First message in slow mode was rejected: %q", <-user.Msg)
+	}
+	if user.allowMessage(NewChatMsg(user, "second")) {
+		t.Errorf("Second message in slow mode was allowed.")
+	} else if got := <-user.Msg; !strings.Contains(got, "-> Slow mode: wait 60s.") {
+		t.Errorf("Got %q", got)
+	}
+	for i := 0; i < 2; i++ {
+		if !op.allowMessage(NewChatMsg(op, "op")) {
+			t.Errorf("Op was held back by slow mode.")
+		}
+	}
+
+	commands.Run(op, "/slowmode off")
+	<-user.Msg
+	if !user.allowMessage(NewChatMsg(user, "third")) {
+		t.Errorf("Message was rejected after slow mode was turned off.")
+	}
+}
+
+func TestMaxRenames(t *testing.T) {
+	server := newTestServer(t)
+	server.NickInterval = 0
+	server.MaxRenames = 2
+	client := newTestClient(server, "alice")
+	op := newTestClient(server, "bob")
+	server.Op(op.Fingerprint())
+
+	for _, name := range []string{"a1", "a2"} {
+		commands.Run(client, "/nick "+name)
+		<-client.Msg
+	}
+	commands.Run(client, "/nick a3")
+	if got := <-client.Msg; !strings.Contains(got, "-> You've changed names too many times this session.") {
+		t.Errorf("Got %q", got)
+	}
+	if client.Name != "a2" {
+		t.Errorf("Renamed to %s past the cap.", client.Name)
+	}
+
+	for _, name := range []string{"b1", "b2", "b3"} {
+		commands.Run(op, "/nick "+name)
+	}
+	if op.Name != "b3" {
+		t.Errorf("Op was capped at %s.", op.Name)
+	}
+}
+
+func TestEdit(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server, "alice")
+
+	commands.Run(client, "/edit hello")
+	if got := <-client.Msg; !strings.Contains(got, "Nothing to edit") {
+		t.Errorf("Got %q", got)
+	}
+
+	client.lastMsg, client.lastMsgAt = "helo wrold", time.Now()
+	commands.Run(client, "/edit hello world")
+	if got := <-client.Msg; !strings.HasSuffix(got, " edited: hello world (was: helo wrold)") {
+		t.Errorf("Got %q", got)
+	}
+	if entries := server.history.Search("alice edited: hello world"); len(entries) != 1 {
+		t.Errorf("Edit isn't in the history.")
+	}
+	if client.lastMsg != "hello world" {
+		t.Errorf("Last message is %q after editing it.", client.lastMsg)
+	}
+
+	client.lastMsgAt = time.Now().Add(-server.EditWindow - time.Second)
+	commands.Run(client, "/edit too late")
+	if got := <-client.Msg; !strings.Contains(got, "messages can only be edited for 30s") {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestAfk(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server, "alice")
+
+	commands.Run(client, "/afk")
+	if got := <-client.Msg; !strings.Contains(got, "You're away: afk.") || client.away != "afk" {
+		t.Errorf("Got %q, away %q", got, client.away)
+	}
+	commands.Run(client, "/afk getting coffee")
+	if got := <-client.Msg; !strings.Contains(got, "You're away: getting coffee.") {
+		t.Errorf("Got %q", got)
+	}
+	commands.Run(client, "/back")
+	if got := <-client.Msg; !strings.Contains(got, "Welcome back.") || client.IsAway() {
+		t.Errorf("Got %q, away %v", got, client.IsAway())
+	}
+}
+
+func TestBadge(t *testing.T) {
+	server := newTestServer(t)
+	op := newTestClient(server, "alice")
+	server.Op(op.Fingerprint())
+	user := newTestClient(server, "bob")
+
+	commands.Run(op, "/badge bob V\x1b[1mIP!")
+	if got := <-op.Msg; !strings.Contains(got, "Gave bob the badge [V1mIP].") {
+		t.Errorf("Got %q", got)
+	}
+	if got := NewChatMsg(user, "hi").String(); got != "[V1mIP] bob: hi" {
+		t.Errorf("Got %q", got)
+	}
+
+	commands.Run(op, "/badge bob "+strings.Repeat("x", MAX_BADGE_LENGTH+1))
+	if got := <-op.Msg; !strings.Contains(got, "at most") {
+		t.Errorf("Got %q for a long badge", got)
+	}
+
+	// Badges follow the key, not the name.
+	server.Rename(user, "carol")
+	if got := NewChatMsg(user, "hi").String(); got != "[V1mIP] carol: hi" {
+		t.Errorf("Got %q after renaming", got)
+	}
+
+	commands.Run(op, "/unbadge carol")
+	<-op.Msg
+	if got := NewChatMsg(user, "hi").String(); got != "carol: hi" {
+		t.Errorf("Got %q after /unbadge", got)
+	}
+}
+
+func TestQueryLimit(t *testing.T) {
+	server := newTestServer(t)
+	server.QueryInterval = time.Hour
+	server.QueryBurst = 2
+	user := newTestClient(server, "alice")
+	op := newTestClient(server, "bob")
+	server.Op(op.Fingerprint())
+
+	for i := 0; i < 2; i++ {
+		commands.Run(user, "/whois bob")
+		if got := <-user.Msg; strings.Contains(got, "Slow down.") {
+			t.Fatalf("Query %d was limited.", i)
+		}
+	}
+	commands.Run(user, "/list")
+	if got := <-user.Msg; !strings.Contains(got, "-> Slow down.") {
+		t.Errorf("Got %q", got)
+	}
+	commands.Run(user, "/motd")
+	if got := <-user.Msg; strings.Contains(got, "Slow down.") {
+		t.Errorf("Command that isn't a query was limited.")
+	}
+
+	for i := 0; i < 3; i++ {
+		commands.Run(op, "/whois alice")
+		if got := <-op.Msg; strings.Contains(got, "Slow down.") {
+			t.Fatalf("Op was limited.")
+		}
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	server := newTestServer(t)
+	user := newTestClient(server, "alice")
+	op := newTestClient(server, "bob")
+	server.Op(op.Fingerprint())
+
+	commands.Run(user, "/ping")
+	if got := <-user.Msg; !strings.Contains(got, "pong") {
+		t.Fatalf("Got %q", got)
+	}
+	commands.Run(user, "/ping")
+	if got := <-user.Msg; !strings.Contains(got, "-> /ping is on cooldown: wait 5s.") {
+		t.Errorf("Got %q", got)
+	}
+	for i := 0; i < 2; i++ {
+		commands.Run(op, "/ping")
+		if got := <-op.Msg; !strings.Contains(got, "pong") {
+			t.Errorf("Op got %q", got)
+		}
+	}
+
+	// A cooldown can be set for a command without one, or turned off.
+	server.Cooldowns = map[string]time.Duration{"/motd": time.Minute, "/ping": 0}
+	commands.Run(user, "/ping")
+	if got := <-user.Msg; !strings.Contains(got, "pong") {
+		t.Errorf("Got %q with the cooldown turned off", got)
+	}
+	commands.Run(user, "/motd")
+	<-user.Msg
+	commands.Run(user, "/motd")
+	if got := <-user.Msg; !strings.Contains(got, "/motd is on cooldown: wait 60s.") {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestWarn(t *testing.T) {
+	server := newTestServer(t)
+	op := newTestClient(server, "alice")
+	server.Op(op.Fingerprint())
+	user := newTestClient(server, "bob")
+	other := newTestClient(server, "carol")
+
+	commands.Run(op, "/warn bob please stop  that")
+	if got := <-user.Msg; !strings.Contains(got, "[SERVER WARNING] please stop  that") {
+		t.Errorf("Got %q", got)
+	}
+	if got := <-op.Msg; !strings.Contains(got, "Warned bob.") {
+		t.Errorf("Got %q", got)
+	}
+	if len(other.Msg) != 0 || len(server.history.Search("WARNING")) != 0 {
+		t.Errorf("Warning wasn't private.")
+	}
+
+	commands.Run(op, "/warn dave hi")
+	if got := <-op.Msg; !strings.Contains(got, "No such name: dave") {
+		t.Errorf("Got %q", got)
+	}
+	commands.Run(user, "/warn carol hi")
+	if got := <-user.Msg; !strings.Contains(got, "You're not an admin.") {
+		t.Errorf("Got %q", got)
+	}
+
+	// A client that isn't keeping up doesn't hold up the op.
+	for len(other.Msg) < MSG_BUFFER {
+		other.Msg <- "backlog"
+	}
+	done := make(chan struct{})
+	go func() {
+		commands.Run(op, "/warn carol hi")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Warning a client with a full buffer blocked the op.")
+	}
+}
+
+func TestBanReason(t *testing.T) {
+	server := newTestServer(t)
+	channel := &recordingChannel{fakeChannel: newFakeChannel()}
+	op := newTestConnClient(server, "alice", channel)
+	server.clients.Set("alice", op)
+	server.Op(op.Fingerprint())
+	newTestClient(server, "bob")
+
+	commands.Run(op, "/ban bob spam\x1b[31m, lots of it.")
+	<-op.Msg
+	ban, banned := server.lookupBan("fp-bob")
+	if !banned || ban.Reason != "spam, lots of it" {
+		t.Fatalf("Got ban %+v, %v", ban, banned)
+	}
+	if notice := banNotice(ban); notice != "You are banned from this server: spam, lots of it." {
+		t.Errorf("Got notice %q", notice)
+	}
+
+	commands.Run(op, "/banlist")
+	if got := channel.written.String(); !strings.Contains(got, "1 banned:") || !strings.Contains(got, "fp-bob: spam, lots of it") {
+		t.Errorf("Got %q", got)
+	}
+
+	server.Ban("fp-carol", nil, strings.Repeat("x", 2*MAX_BAN_REASON_LENGTH))
+	if bans := server.Bans(); len(bans) != 2 || len([]rune(bans[1].Reason)) != MAX_BAN_REASON_LENGTH {
+		t.Errorf("Long reason wasn't truncated: %+v", bans)
+	}
+}
+
+func TestExitReason(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(server, "alice")
+	bob := newTestClient(server, "bob")
+
+	commands.Run(alice, "/exit bye\x1b[31m "+strings.Repeat("x", 2*MAX_LEAVE_REASON_LENGTH))
+	left := server.history.Search("alice left")
+	if len(left) != 1 || strings.Contains(left[0].Msg, "\x1b") || len([]rune(left[0].Msg)) > MAX_LEAVE_REASON_LENGTH+len("* alice left ().") {
+		t.Errorf("Reason wasn't cleaned and truncated: %q", left)
+	}
+
+	bob.Silence(time.Minute)
+	commands.Run(bob, "/exit look at me")
+	if left := server.history.Search("bob left"); len(left) != 1 || strings.Contains(left[0].Msg, "look at me") {
+		t.Errorf("Silenced user left with a reason: %q", left)
+	}
+}
+
+func TestExitAnnounced(t *testing.T) {
+	server := newTestServer(t)
+	server.RejoinWindow = time.Minute
+	alice := newTestConnClient(server, "alice", newFakeChannel())
+	server.Add(alice)
+
+	// Leaving on purpose isn't held back like a dropped connection.
+	commands.Run(alice, "/exit")
+	if left := server.history.Search("alice left."); len(left) != 1 {
+		t.Errorf("Leave wasn't announced right away: %q", server.history.Get(10))
+	}
+}
+
+func TestOpKeyless(t *testing.T) {
+	server := newTestServer(t)
+	op := newTestClient(server, "alice")
+	server.Op(op.Fingerprint())
+	// Like WebSocket clients with a token, these have no key, but aren't guests.
+	first := NewClient(server, &fakeConn{user: "ws1", closed: make(chan struct{})})
+	second := NewClient(server, &fakeConn{user: "ws2", closed: make(chan struct{})})
+	server.clients.Set("ws1", first)
+	server.clients.Set("ws2", second)
+
+	commands.Run(op, "/op ws1")
+	if got := <-op.Msg; !strings.Contains(got, "ws1 has no key") {
+		t.Errorf("Got %q", got)
+	}
+	if server.IsOp(first) || server.IsOp(second) {
+		t.Errorf("Client without a key was made an op.")
+	}
+
+	// Even with an empty fingerprint among the ops, keyless clients aren't.
+	server.Op("")
+	if server.IsOp(second) {
+		t.Errorf("Client without a key is an op.")
+	}
+	if err := server.SaveOp("", true); err == nil {
+		t.Errorf("Saved an empty fingerprint as an op.")
+	}
+}
+
+func TestSettingsConcurrent(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server, "alice")
+	go func() {
+		for range client.Msg {
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			commands.Run(client, "/quiet on")
+			commands.Run(client, "/set theme monochrome")
+			commands.Run(client, "/set compact on")
+			commands.Run(client, "/quiet off")
+			commands.Run(client, "/set color on")
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		server.BroadcastPresence("* bob joined.", nil)
+		client.SysMsg("hello")
+		client.Warn("behave")
+	}
+	<-done
+	close(client.Msg)
+}
+
+func TestPerms(t *testing.T) {
+	server := newTestServer(t)
+	user := newTestClient(server, "alice")
+	op := newTestClient(server, "bob")
+	server.Op(op.Fingerprint())
+
+	commands.Run(user, "/perms")
+	if got := <-user.Msg; !strings.Contains(got, "You are a user. Only ops can use: /appendmotd, /badge, /ban,") {
+		t.Errorf("Got %q", got)
+	}
+	commands.Run(op, "/perms")
+	if got := <-op.Msg; !strings.Contains(got, "You are an op") || strings.Contains(got, "/whois") {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestForceNick(t *testing.T) {
+	server := newTestServer(t)
+	op := newTestClient(server, "alice")
+	server.Op(op.Fingerprint())
+	user := newTestClient(server, "bob")
+	newTestClient(server, "carol")
+
+	commands.Run(op, "/forcenick bob carol")
+	if got := <-op.Msg; !strings.Contains(got, "carol is not available.") {
+		t.Errorf("Got %q", got)
+	}
+
+	commands.Run(op, "/forcenick bob dave")
+	if user.Name != "dave" || server.Who("dave") != user || server.Who("bob") != nil {
+		t.Fatalf("Wasn't renamed, name is %q", user.Name)
+	}
+	if got := <-user.Msg; !strings.Contains(got, "* bob is now known as dave.") {
+		t.Errorf("Got %q", got)
+	}
+	if got := <-user.Msg; !strings.Contains(got, "You were renamed to dave by alice.") {
+		t.Errorf("Got %q", got)
+	}
+	if user.renameCount != 0 {
+		t.Errorf("Forced rename counted against the user.")
+	}
+
+	commands.Run(user, "/forcenick alice eve")
+	if got := <-user.Msg; !strings.Contains(got, "You're not an admin.") {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestAgain(t *testing.T) {
+	server := newTestServer(t)
+	server.MessageInterval = 0
+	sender := newTestClient(server, "alice")
+	other := newTestClient(server, "bob")
+
+	commands.Run(sender, "/again")
+	if got := <-sender.Msg; !strings.Contains(got, "Nothing to send again.") {
+		t.Errorf("Got %q", got)
+	}
+
+	sender.say("hello", false)
+	if got := <-other.Msg; !strings.HasSuffix(got, ": hello") {
+		t.Errorf("Got %q", got)
+	}
+	commands.Run(sender, "/again")
+	for _, client := range []*Client{sender, other} {
+		if got := <-client.Msg; !strings.HasSuffix(got, ": hello") {
+			t.Errorf("%s got %q", client.Name, got)
+		}
+	}
+
+	for i := 0; i < SENT_HISTORY+5; i++ {
+		sender.say(fmt.Sprintf("line %d", i), false)
+	}
+	if len(sender.sent) != SENT_HISTORY || sender.sent[SENT_HISTORY-1] != fmt.Sprintf("line %d", SENT_HISTORY+4) {
+		t.Errorf("History wasn't capped, got %q", sender.sent)
+	}
+}
+
+func TestMuteNotices(t *testing.T) {
+	server := newTestServer(t)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	server.Clock = func() time.Time { return now }
+	client := newTestClient(server, "alice")
+	other := newTestClient(server, "bob")
+
+	commands.Run(client, "/mutenotices 1m")
+	if got := <-client.Msg; !strings.Contains(got, "Notices are hidden for 1m0s.") {
+		t.Errorf("Got %q", got)
+	}
+	server.Broadcast("an announcement", nil)
+	server.BroadcastPresence("* carol joined.", nil)
+	server.BroadcastMessage(NewChatMsg(other, "hello"), other)
+	if got := <-client.Msg; !strings.HasSuffix(got, ": hello") {
+		t.Errorf("Expected only chat, got %q", got)
+	}
+	if len(client.Msg) != 0 {
+		t.Errorf("Muted notices were delivered.")
+	}
+
+	now = now.Add(time.Minute)
+	server.Broadcast("another announcement", nil)
+	if got := <-client.Msg; !strings.Contains(got, "another announcement") {
+		t.Errorf("Notices didn't come back, got %q", got)
+	}
+
+	commands.Run(client, "/mutenotices")
+	<-client.Msg
+	commands.Run(client, "/mutenotices off")
+	<-client.Msg
+	if client.NoticesMuted() {
+		t.Errorf("Notices are still muted after off.")
+	}
+	commands.Run(client, "/mutenotices -1m")
+	if got := <-client.Msg; !strings.Contains(got, "Invalid duration: -1m") {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestLastOp(t *testing.T) {
+	server := newTestServer(t)
+	op := newTestClient(server, "alice")
+	server.Op(op.Fingerprint())
+
+	for _, line := range []string{"/deop alice", "/ban alice"} {
+		commands.Run(op, line)
+		if got := <-op.Msg; !strings.Contains(got, "alice is the last op") {
+			t.Errorf("%s: got %q", line, got)
+		}
+		if !server.IsOp(op) {
+			t.Fatalf("%s went through.", line)
+		}
+	}
+
+	// A deopped op from the config comes back on the next reload, but a
+	// banned one can't get back in to be opped.
+	server.fileOps = []string{op.Fingerprint()}
+	if server.isLastOp(op.Fingerprint(), true) {
+		t.Errorf("Op from the config counted as the last op.")
+	}
+	commands.Run(op, "/ban alice")
+	if got := <-op.Msg; !strings.Contains(got, "alice is the last op") || server.IsBanned(op.Fingerprint()) {
+		t.Errorf("Last op from the config was banned: %q", got)
+	}
+	server.PersistOps, server.opFile = true, "ops.txt"
+	if !server.isLastOp(op.Fingerprint(), true) {
+		t.Errorf("Persisted deop wasn't refused.")
+	}
+	server.PersistOps = false
+
+	other := newTestClient(server, "bob")
+	server.Op(other.Fingerprint())
+	commands.Run(op, "/deop alice")
+	<-op.Msg
+	if server.IsOp(op) {
+		t.Errorf("Couldn't deop with another op around.")
+	}
+}
+
+func TestClearHistory(t *testing.T) {
+	server := newTestServer(t)
+	op := newTestClient(server, "alice")
+	server.Op(op.Fingerprint())
+	server.Broadcast("bob: something regrettable", nil)
+
+	commands.Run(op, "/clearhistory")
+	got := server.history.Get(10)
+	if len(got) != 1 || got[0] != "* History cleared by alice." {
+		t.Errorf("Got history: %q", got)
+	}
+}
+
+func TestHistoryRepliesDontBlock(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server, "bob")
+	server.history.Add("bob: hi")
+	server.mentions.Add(client.Identity(), "alice: bob?")
+	for len(client.Msg) < MSG_BUFFER {
+		client.Msg <- "backlog"
+	}
+
+	done := make(chan struct{})
+	go func() {
+		commands.Run(client, "/last")
+		commands.Run(client, "/search hi")
+		client.sendMentions()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Replying to a client with a full buffer blocked.")
+	}
+}
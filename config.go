@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MAX_BANNER_LENGTH keeps the pre-auth banner short.
+const MAX_BANNER_LENGTH = 1024
+
+// Duration is a time.Duration written as a string like "5m" in config files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Config holds the server settings that can be loaded from a JSON file.
+// Command line flags take precedence over values from the file.
+type Config struct {
+	Bind           string   `json:"bind"`
+	TelnetAddr     string   `json:"telnet_addr"`
+	WSAddr         string   `json:"ws_addr"`
+	HTTPAddr       string   `json:"http_addr"`
+	WSToken        string   `json:"ws_token"`
+	WSOrigins      []string `json:"ws_origins"`
+	OnEmpty        string   `json:"on_empty"`
+	Bots           []string `json:"bots"`
+	Identity       string   `json:"identity"`
+	Admins         []string `json:"admins"`     // fingerprints
+	Banned         []string `json:"banned"`     // fingerprints
+	Motd           string   `json:"motd"`       // path to the MOTD file
+	Banner         string   `json:"banner"`     // path to the pre-auth banner file
+	BannerArt      string   `json:"banner_art"` // path to ASCII art shown on connect
+	Name           string   `json:"name"`       // of the room, shown on joining
+	Greeting       string   `json:"greeting"`   // sent after the MOTD, with $NAME replaced
+	OpFile         string   `json:"opfile"`     // path to a file of admin fingerprints
+	BanFile        string   `json:"banfile"`    // path to a file of banned fingerprints
+	BadgeFile      string   `json:"badgefile"`  // path to a file of badges by fingerprint
+	PinFile        string   `json:"pinfile"`    // path to a file of the message pinned with /pin
+	Responders     string   `json:"responders"` // path to a JSON file of auto-responder rules
+	Lang           string   `json:"lang"`       // path to a JSON file of translated messages
+	SilenceDefault Duration `json:"silence_default"`
+	SilencePublic  bool     `json:"silence_public"`
+	LoginAttempts  int      `json:"login_attempts"`
+	LoginLockout   Duration `json:"login_lockout"`
+	PersistOps     bool     `json:"persist_ops"`
+	PersistMotd    bool     `json:"persist_motd"`
+	RoomPrompt     bool     `json:"room_prompt"`
+	AwayAfter      Duration `json:"away_after"`
+	IdleTimeout    Duration `json:"idle_timeout"`
+	Keepalive      Duration `json:"keepalive"`
+
+	HandshakeTimeout Duration `json:"handshake_timeout"`
+
+	JanitorInterval Duration `json:"janitor_interval"`
+	MentionTTL      Duration `json:"mention_ttl"`
+	MuteNotices     Duration `json:"mute_notices_default"`
+
+	CoalesceWindow Duration `json:"coalesce_window"`
+	CoalesceMax    int      `json:"coalesce_max"`
+
+	HistoryLen   int `json:"history_len"`
+	HistoryBytes int `json:"history_bytes"`
+
+	MessageInterval Duration `json:"message_interval"`
+	MessageBurst    int      `json:"message_burst"`
+	NickInterval    Duration `json:"nick_interval"`
+	NickBurst       int      `json:"nick_burst"`
+	QueryInterval   Duration `json:"query_interval"`
+	QueryBurst      int      `json:"query_burst"`
+	MaxRenames      int      `json:"max_renames"`
+	MaxClients      int      `json:"max_clients"`
+	RejoinWindow    Duration `json:"rejoin_window"`
+	EditWindow      Duration `json:"edit_window"`
+
+	VersionLength int `json:"version_length"`
+	MaxNameLength int `json:"max_name_length"`
+
+	// Cooldowns override how long a non-op must wait between uses of a
+	// command, like {"/me": "10s"}.
+	Cooldowns map[string]Duration `json:"cooldowns"`
+
+	// Messages reword the rejections sent to clients, by key, like
+	// {"not_op": "Ops only."}. See defaultMessages for the keys.
+	Messages map[string]string `json:"messages"`
+
+	// keys are those given in the config file, so that a value of 0, false,
+	// or "" there can still override a flag's default.
+	keys map[string]json.RawMessage
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &config.keys); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &config, nil
+}
+
+// has reports whether key was given in the config file.
+func (c *Config) has(key string) bool {
+	_, ok := c.keys[key]
+	return ok
+}
+
+// ReadMotd returns the contents of the config's MOTD file, if any.
+func (c *Config) ReadMotd() (string, error) {
+	return readText(c.Motd)
+}
+
+// ReadPin returns the message pinned in the config's pin file, if any.
+func (c *Config) ReadPin() (string, error) {
+	pin, err := readText(c.PinFile)
+	if os.IsNotExist(err) {
+		// It's created when something is first pinned.
+		return "", nil
+	}
+	return pin, err
+}
+
+// ReadBanner returns the contents of the config's pre-auth banner file, if
+// any, truncated to MAX_BANNER_LENGTH.
+func (c *Config) ReadBanner() (string, error) {
+	banner, err := readText(c.Banner)
+	if len(banner) > MAX_BANNER_LENGTH {
+		banner = banner[:MAX_BANNER_LENGTH]
+	}
+	return banner, err
+}
+
+// ReadBannerArt returns the contents of the config's ASCII art file. A
+// missing file is logged and skipped rather than treated as an error.
+func (c *Config) ReadBannerArt() string {
+	art, err := readText(c.BannerArt)
+	if err != nil {
+		logger.Warningf("Skipping banner art: %v", err)
+		return ""
+	}
+	return strings.Replace(art, "\r\n", "\n", -1)
+}
+
+// readText returns the contents of path without trailing newlines. An empty
+// path yields an empty string.
+func readText(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Ops returns the admin fingerprints from the config and its op file.
+func (c *Config) Ops() ([]string, error) {
+	ops, err := readFingerprints(c.OpFile)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]string{}, c.Admins...), ops...), nil
+}
+
+// Bans returns the banned fingerprints from the config and its ban file.
+func (c *Config) Bans() ([]string, error) {
+	bans, err := readFingerprints(c.BanFile)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]string{}, c.Banned...), bans...), nil
+}
+
+// ReadMessages returns the wording of the messages sent to clients: the
+// translations from the lang file, if any, with those from the config's
+// "messages" on top.
+func (c *Config) ReadMessages() (map[string]string, error) {
+	messages := map[string]string{}
+	if c.Lang != "" {
+		data, err := ioutil.ReadFile(c.Lang)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("%s: %v", c.Lang, err)
+		}
+	}
+	for key, msg := range c.Messages {
+		messages[key] = msg
+	}
+	return messages, nil
+}
+
+// Badges returns the badges from the badge file by fingerprint, or nil if
+// there is no badge file.
+func (c *Config) Badges() (map[string]string, error) {
+	if c.BadgeFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(c.BadgeFile)
+	if os.IsNotExist(err) {
+		// It's created when the first badge is given.
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	badges := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: expected a fingerprint and a badge: %q", c.BadgeFile, line)
+		}
+		badges[fields[0]] = fields[1]
+	}
+	return badges, nil
+}
+
+// writeBadges replaces the badge file at path with badges, a fingerprint and
+// badge per line.
+func writeBadges(path string, badges map[string]string) error {
+	lines := []string{}
+	for fingerprint, badge := range badges {
+		lines = append(lines, fingerprint+" "+badge+"\n")
+	}
+	sort.Strings(lines)
+	return writeFile(path, strings.Join(lines, ""))
+}
+
+// readFingerprints reads one fingerprint per line from path, skipping blank
+// lines and lines starting with "#". An empty path yields no fingerprints.
+func readFingerprints(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r = append(r, line)
+	}
+	return r, nil
+}
+
+// updateFingerprints adds or removes fingerprint in the file at path, keeping
+// its other lines and comments. The file is replaced rather than rewritten in
+// place, so readers never see it half written.
+func updateFingerprints(path string, fingerprint string, add bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := []string{}
+	found := false
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			if strings.TrimSpace(line) == fingerprint {
+				found = true
+				if !add {
+					continue
+				}
+			}
+			lines = append(lines, line)
+		}
+	}
+	if found == add {
+		return nil
+	}
+	if add {
+		lines = append(lines, fingerprint)
+	}
+	return writeFile(path, strings.Join(lines, "\n")+"\n")
+}
+
+// writeFile replaces the contents of path with data. It writes to a temporary
+// file first, so that readers never see a partly written file.
+func writeFile(path string, data string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdateFingerprints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh-chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ops.txt")
+	if err := ioutil.WriteFile(path, []byte("# ops\naa\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		fingerprint string
+		add         bool
+		want        string
+	}{
+		{"bb", true, "# ops\naa\nbb\n"},
+		{"bb", true, "# ops\naa\nbb\n"},
+		{"aa", false, "# ops\nbb\n"},
+		{"cc", false, "# ops\nbb\n"},
+	}
+	for _, step := range steps {
+		if err := updateFingerprints(path, step.fingerprint, step.add); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadFile(path)
+		if string(data) != step.want {
+			t.Errorf("After updating %s (add: %v), got %q, expected %q", step.fingerprint, step.add, data, step.want)
+		}
+	}
+}
+
+func TestSaveOpConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh-chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := newTestServer(t)
+	server.PersistOps = true
+	server.opFile = filepath.Join(dir, "ops.txt")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := server.SaveOp(fmt.Sprintf("fp%d", i), true); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ops, err := readFingerprints(server.opFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 20 {
+		t.Errorf("Saved %d ops, expected 20: %v", len(ops), ops)
+	}
+}
+
+func TestSaveBadges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh-chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{BadgeFile: filepath.Join(dir, "badges.txt")}
+	server := newTestServer(t)
+	if err := server.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	server.SetBadge("fp1", "VIP")
+	server.SetBadge("fp2", "mod")
+	if err := server.SaveBadges(); err != nil {
+		t.Fatal(err)
+	}
+
+	badges, err := config.Badges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(badges) != 2 || badges["fp1"] != "VIP" || badges["fp2"] != "mod" {
+		t.Errorf("Got badges %v", badges)
+	}
+}
+
+func TestReloadKeepsBans(t *testing.T) {
+	server := newTestServer(t)
+	config := &Config{Banned: []string{"fp-bob", "fp-carol"}}
+	if err := server.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+
+	duration := time.Hour
+	server.Ban("fp-bob", &duration, "spam")
+	if err := server.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	ban, banned := server.lookupBan("fp-bob")
+	if !banned || ban.Reason != "spam" || ban.Until == nil {
+		t.Errorf("Reload replaced the ban from /ban: %+v", ban)
+	}
+	if !server.IsBanned("fp-carol") {
+		t.Errorf("Ban from the config was lost.")
+	}
+}
+
+func TestReloadWhileCheckingOps(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(server, "alice")
+	bob := newTestClient(server, "bob")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			admins := []string{"fp-alice"}
+			if i%2 == 0 {
+				admins = nil
+			}
+			if err := server.Configure(&Config{Admins: admins, Banned: admins}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			server.Op(bob.Fingerprint())
+			server.Deop(bob.Fingerprint())
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		server.IsOp(alice)
+		server.IsOp(bob)
+	}
+	wg.Wait()
+}
+
+func TestLang(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh-chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "de.json")
+	lang := `{"not_op": "Nur für Admins.", "welcome": "Willkommen!", "help /nick": "Namen ändern."}`
+	if err := ioutil.WriteFile(path, []byte(lang), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Lang: path, Messages: map[string]string{"not_op": "Ops only."}}
+	server := newTestServer(t)
+	if err := server.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{
+		"not_op":       "Ops only.",
+		"welcome":      "Willkommen!",
+		"help /nick":   "Namen ändern.",
+		"no_such_name": "No such name: %s",
+	} {
+		if got := server.messages.Get(key); got != want {
+			t.Errorf("Got %q for %s, expected %q", got, key, want)
+		}
+	}
+	if help := commands.Help(false, server.messages); !containsLine(help, "Namen ändern.") {
+		t.Errorf("Help wasn't translated: %q", help)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"help /nope": "?"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Configure(config); err == nil {
+		t.Errorf("Expected an error for an unknown command's help.")
+	}
+}
+
+// containsLine reports whether any of lines contains s.
+func containsLine(lines []string, s string) bool {
+	for _, line := range lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
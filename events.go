@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// How many events can be waiting for subscribers before new ones are dropped.
+const EVENT_QUEUE = 100
+
+// How long the --on-empty webhook has to answer.
+const WEBHOOK_TIMEOUT = 10 * time.Second
+
+// EventType is a step in a connection's lifecycle.
+type EventType int
+
+const (
+	EventConnected     EventType = iota // a connection was accepted
+	EventAuthenticated                  // an SSH handshake, or a WebSocket token, was accepted
+	EventShellStarted                   // the client joined the room
+	EventRenamed                        // the client changed names, from OldName
+	EventDisconnected                   // the client left the room
+	EventRoomEmpty                      // the client was the last to leave
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventAuthenticated:
+		return "authenticated"
+	case EventShellStarted:
+		return "shell-started"
+	case EventRenamed:
+		return "renamed"
+	case EventDisconnected:
+		return "disconnected"
+	case EventRoomEmpty:
+		return "room-empty"
+	}
+	return "unknown"
+}
+
+// Event is a change in a connection's lifecycle. Name and Fingerprint are
+// empty for SSH connections that haven't finished the handshake, and
+// Fingerprint is always empty for guests, who have no key.
+type Event struct {
+	Type        EventType
+	Time        time.Time
+	Name        string
+	OldName     string
+	Fingerprint string
+	RemoteAddr  string
+}
+
+// newEvent returns an event of type t for client.
+func newEvent(t EventType, client *Client) Event {
+	return Event{
+		Type:        t,
+		Time:        client.Server.Clock(),
+		Name:        client.Name,
+		Fingerprint: client.Fingerprint(),
+		RemoteAddr:  client.Conn.RemoteAddr().String(),
+	}
+}
+
+// Subscribe registers fn to be called with each lifecycle event. Events are
+// delivered in order, one at a time, away from the code that emits them, so
+// a slow subscriber only delays other subscribers.
+func (s *Server) Subscribe(fn func(Event)) {
+	s.eventLock.Lock()
+	defer s.eventLock.Unlock()
+
+	if s.events == nil {
+		s.events = make(chan Event, EVENT_QUEUE)
+		go s.runSubscribers()
+	}
+	s.subscribers = append(s.subscribers, fn)
+}
+
+// emit queues e for the subscribers, dropping it if they're behind.
+func (s *Server) emit(e Event) {
+	s.eventLock.RLock()
+	events := s.events
+	s.eventLock.RUnlock()
+	if events == nil {
+		return
+	}
+	select {
+	case events <- e:
+	default:
+		logger.Warningf("Dropped %s event for %s, queue is full", e.Type, e.Name)
+	}
+}
+
+func (s *Server) runSubscribers() {
+	for {
+		select {
+		case e := <-s.events:
+			s.eventLock.RLock()
+			subscribers := s.subscribers
+			s.eventLock.RUnlock()
+			for _, fn := range subscribers {
+				callSubscriber(fn, e)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// callSubscriber calls fn, so that a subscriber that panics doesn't take the
+// server down.
+func callSubscriber(fn func(Event), e Event) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Errorf("Event subscriber failed on %s: %v", e.Type, err)
+		}
+	}()
+	fn(e)
+}
+
+// emptyHook is the JSON posted to the --on-empty webhook.
+type emptyHook struct {
+	Event string    `json:"event"`
+	Room  string    `json:"room"`
+	Time  time.Time `json:"time"`
+}
+
+// OnEmpty returns a subscriber that acts when the room empties, as set with
+// --on-empty: "log" logs it, and an http or https URL is sent the event as
+// JSON in a POST.
+func (s *Server) OnEmpty(action string) (func(Event), error) {
+	if action == "log" {
+		return func(e Event) {
+			if e.Type == EventRoomEmpty {
+				logger.Infof("The room is empty, %s was the last to leave", e.Name)
+			}
+		}, nil
+	}
+
+	u, err := url.Parse(action)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("expected log or an http(s) URL, got %q", action)
+	}
+	client := &http.Client{Timeout: WEBHOOK_TIMEOUT}
+	return func(e Event) {
+		if e.Type != EventRoomEmpty {
+			return
+		}
+		body, _ := json.Marshal(emptyHook{Event: e.Type.String(), Room: s.RoomName, Time: e.Time})
+		resp, err := client.Post(action, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logger.Errorf("Failed to call the room empty webhook: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logger.Errorf("Room empty webhook answered %s", resp.Status)
+		}
+	}, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLifecycleEvents(t *testing.T) {
+	server := newTestServer(t)
+	events := make(chan Event, 10)
+	server.Subscribe(func(e Event) { events <- e })
+
+	client := newTestConnClient(server, "alice", newFakeChannel())
+	server.Add(client)
+	server.Rename(client, "alicia")
+	server.Leave(client, "")
+
+	want := []struct {
+		t       EventType
+		name    string
+		oldName string
+	}{
+		{EventShellStarted, "alice", ""},
+		{EventRenamed, "alicia", "alice"},
+		{EventDisconnected, "alicia", ""},
+		{EventRoomEmpty, "alicia", ""},
+	}
+	for _, w := range want {
+		select {
+		case e := <-events:
+			if e.Type != w.t || e.Name != w.name || e.OldName != w.oldName {
+				t.Errorf("Got %s event for %q from %q, expected %s for %q from %q", e.Type, e.Name, e.OldName, w.t, w.name, w.oldName)
+			}
+			if e.Fingerprint != "fp-alice" || e.RemoteAddr != "127.0.0.1:1234" {
+				t.Errorf("Event is missing the client: %+v", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for %s event.", w.t)
+		}
+	}
+
+	// Leaving again is a no-op, and shouldn't be reported twice.
+	server.Leave(client, "")
+	select {
+	case e := <-events:
+		t.Errorf("Got an extra %s event.", e.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscriberPanic(t *testing.T) {
+	server := newTestServer(t)
+	events := make(chan Event, 10)
+	server.Subscribe(func(e Event) { panic("oops") })
+	server.Subscribe(func(e Event) { events <- e })
+
+	server.emit(Event{Type: EventConnected})
+	select {
+	case e := <-events:
+		if e.Type != EventConnected {
+			t.Errorf("Got %s event.", e.Type)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("A panicking subscriber stopped the others.")
+	}
+}
+
+func TestRoomEmptyEvent(t *testing.T) {
+	server := newTestServer(t)
+	events := make(chan Event, 10)
+	server.Subscribe(func(e Event) {
+		if e.Type == EventRoomEmpty {
+			events <- e
+		}
+	})
+
+	alice := newTestConnClient(server, "alice", newFakeChannel())
+	bob := newTestConnClient(server, "bob", newFakeChannel())
+	server.Add(alice)
+	server.Add(bob)
+	server.Leave(alice, "bye")
+	select {
+	case <-events:
+		t.Fatal("Room emptied with bob still in it.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	server.Leave(bob, "bye")
+	select {
+	case e := <-events:
+		if e.Name != "bob" {
+			t.Errorf("Room emptied when %q left.", e.Name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the room to empty.")
+	}
+}
+
+func TestOnEmpty(t *testing.T) {
+	server := newTestServer(t)
+	for _, action := range []string{"", "nope", "ftp://example.com/", "http://"} {
+		if _, err := server.OnEmpty(action); err == nil {
+			t.Errorf("Accepted --on-empty %q", action)
+		}
+	}
+	if _, err := server.OnEmpty("log"); err != nil {
+		t.Error(err)
+	}
+
+	hooks := make(chan emptyHook, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := emptyHook{}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		hooks <- got
+	}))
+	defer hook.Close()
+
+	onEmpty, err := server.OnEmpty(hook.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onEmpty(Event{Type: EventDisconnected})
+	onEmpty(Event{Type: EventRoomEmpty, Time: time.Now()})
+	select {
+	case got := <-hooks:
+		if got.Event != "room-empty" || got.Room != server.RoomName || got.Time.IsZero() {
+			t.Errorf("Got %+v", got)
+		}
+	default:
+		t.Fatal("Webhook wasn't called.")
+	}
+	select {
+	case got := <-hooks:
+		t.Errorf("Webhook called for another event: %+v", got)
+	default:
+	}
+}
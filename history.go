@@ -1,38 +1,112 @@
 // TODO: Split this out into its own module, it's kinda neat.
 package main
 
-import "sync"
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HistoryEntry is a single line of history and when it was added.
+type HistoryEntry struct {
+	Time time.Time
+	Msg  string
+}
+
+// String formats the entry prefixed with its timestamp.
+func (e HistoryEntry) String() string {
+	return fmt.Sprintf("[%s] %s", e.Time.Format("15:04:05"), e.Msg)
+}
 
 type History struct {
-	entries []string
-	head    int
-	size    int
-	lock    sync.Mutex
+	entries  []HistoryEntry
+	head     int
+	size     int
+	bytes    int
+	maxBytes int
+	lock     sync.Mutex
+
+	// Clock tells the time entries are added at.
+	Clock Clock
 }
 
-func NewHistory(size int) *History {
+// NewHistory returns a history holding up to size entries and, if maxBytes
+// is positive, up to maxBytes of messages in total.
+func NewHistory(size int, maxBytes int) *History {
 	return &History{
-		entries: make([]string, size),
+		entries:  make([]HistoryEntry, size),
+		maxBytes: maxBytes,
 	}
 }
 
+// Add appends entry, evicting the oldest entries if either limit is exceeded.
+// An entry that is larger than the byte limit on its own is truncated, at the
+// start of a rune so that none is cut in half.
 func (h *History) Add(entry string) {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
+	if h.maxBytes > 0 && len(entry) > h.maxBytes {
+		end := h.maxBytes
+		for end > 0 && !utf8.RuneStart(entry[end]) {
+			end--
+		}
+		entry = entry[:end]
+	}
+
 	max := cap(h.entries)
 	h.head = (h.head + 1) % max
-	h.entries[h.head] = entry
+	h.bytes += len(entry) - len(h.entries[h.head].Msg)
+	h.entries[h.head] = HistoryEntry{Time: h.Clock.Now(), Msg: entry}
 	if h.size < max {
 		h.size++
 	}
+
+	for h.maxBytes > 0 && h.bytes > h.maxBytes {
+		oldest := (h.head - h.size + 1 + max) % max
+		h.bytes -= len(h.entries[oldest].Msg)
+		h.entries[oldest] = HistoryEntry{}
+		h.size--
+	}
+}
+
+// Clear removes every entry.
+func (h *History) Clear() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.entries = make([]HistoryEntry, cap(h.entries))
+	h.head, h.size, h.bytes = 0, 0, 0
+}
+
+// Bytes returns the total size of the messages held.
+func (h *History) Bytes() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.bytes
 }
 
 func (h *History) Len() int {
 	return h.size
 }
 
+// Cap returns the maximum number of entries the history can hold.
+func (h *History) Cap() int {
+	return cap(h.entries)
+}
+
 func (h *History) Get(num int) []string {
+	entries := h.Entries(num)
+	r := make([]string, len(entries))
+	for i, entry := range entries {
+		r[i] = entry.Msg
+	}
+	return r
+}
+
+// Entries returns up to num of the most recent entries, oldest first.
+func (h *History) Entries(num int) []HistoryEntry {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
@@ -41,7 +115,7 @@ func (h *History) Get(num int) []string {
 		num = h.size
 	}
 
-	r := make([]string, num)
+	r := make([]HistoryEntry, num)
 	for i := 0; i < num; i++ {
 		idx := (h.head - i) % max
 		if idx < 0 {
@@ -52,3 +126,15 @@ func (h *History) Get(num int) []string {
 
 	return r
 }
+
+// Search returns the entries containing term, ignoring case, oldest first.
+func (h *History) Search(term string) []HistoryEntry {
+	term = strings.ToLower(term)
+	r := []HistoryEntry{}
+	for _, entry := range h.Entries(h.Cap()) {
+		if strings.Contains(strings.ToLower(entry.Msg), term) {
+			r = append(r, entry)
+		}
+	}
+	return r
+}
@@ -3,13 +3,14 @@ package main
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestHistory(t *testing.T) {
 	var r, expected []string
 	var size int
 
-	h := NewHistory(5)
+	h := NewHistory(5, 0)
 
 	r = h.Get(10)
 	expected = []string{}
@@ -51,3 +52,109 @@ func TestHistory(t *testing.T) {
 		t.Errorf("Got: %v, Expected: %v", r, expected)
 	}
 }
+
+func TestHistoryEntries(t *testing.T) {
+	h := NewHistory(3, 0)
+
+	if max := h.Cap(); max != 3 {
+		t.Errorf("Wrong cap: %v", max)
+	}
+
+	before := time.Now()
+	h.Add("1")
+	h.Add("2")
+
+	r := h.Entries(10)
+	if len(r) != 2 {
+		t.Fatalf("Wrong number of entries: %v", len(r))
+	}
+	if r[0].Msg != "1" || r[1].Msg != "2" {
+		t.Errorf("Got: %v, Expected: [1 2]", r)
+	}
+	if r[0].Time.Before(before) {
+		t.Errorf("Entry time %v is before %v", r[0].Time, before)
+	}
+}
+
+func TestHistorySearch(t *testing.T) {
+	h := NewHistory(5, 0)
+	h.Add("foo: Hello")
+	h.Add("bar: hi")
+	h.Add("foo: HELLO again")
+
+	r := h.Search("hello")
+	if len(r) != 2 {
+		t.Fatalf("Wrong number of results: %v", len(r))
+	}
+	if r[0].Msg != "foo: Hello" || r[1].Msg != "foo: HELLO again" {
+		t.Errorf("Got: %v", r)
+	}
+
+	if r = h.Search("nope"); len(r) != 0 {
+		t.Errorf("Got: %v, Expected no results", r)
+	}
+}
+
+func TestHistoryBytes(t *testing.T) {
+	h := NewHistory(10, 10)
+
+	h.Add("1234")
+	h.Add("5678")
+	if size := h.Bytes(); size != 8 {
+		t.Errorf("Wrong byte size: %v", size)
+	}
+
+	h.Add("abcd")
+	if size := h.Bytes(); size > 10 {
+		t.Errorf("Byte size %v exceeds the cap", size)
+	}
+	r := h.Get(10)
+	expected := []string{"5678", "abcd"}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("Got: %v, Expected: %v", r, expected)
+	}
+
+	h.Add("this message is oversized")
+	if size := h.Bytes(); size > 10 {
+		t.Errorf("Byte size %v exceeds the cap", size)
+	}
+	r = h.Get(10)
+	expected = []string{"this messa"}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("Got: %v, Expected: %v", r, expected)
+	}
+
+	// A rune straddling the cap is dropped rather than cut in half.
+	h.Add("abcdefghi\u00e9")
+	r = h.Get(1)
+	expected = []string{"abcdefghi"}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("Got: %q, Expected: %q", r, expected)
+	}
+
+	// The count limit still applies, and evicted entries free their bytes.
+	h = NewHistory(2, 100)
+	h.Add("1")
+	h.Add("22")
+	h.Add("333")
+	if size := h.Bytes(); size != 5 {
+		t.Errorf("Wrong byte size: %v", size)
+	}
+	if size := h.Len(); size != 2 {
+		t.Errorf("Wrong size: %v", size)
+	}
+}
+
+func TestHistoryClear(t *testing.T) {
+	h := NewHistory(3, 100)
+	h.Add("1")
+	h.Add("2")
+	h.Clear()
+	if h.Len() != 0 || h.Bytes() != 0 || len(h.Get(10)) != 0 {
+		t.Errorf("History wasn't cleared: %v", h.Get(10))
+	}
+	h.Add("3")
+	if r := h.Get(10); !reflect.DeepEqual(r, []string{"3"}) {
+		t.Errorf("Got: %v, Expected: [3]", r)
+	}
+}
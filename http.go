@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// StartHTTP serves HTTP on laddr, for load balancers and orchestrators to
+// check on the server without an SSH handshake.
+func (s *Server) StartHTTP(laddr string) error {
+	socket, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Listening for HTTP on %s", laddr)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+
+	go func() {
+		err := http.Serve(socket, mux)
+		logger.Errorf("Stopped serving HTTP: %v", err)
+	}()
+
+	go func() {
+		<-s.done
+		socket.Close()
+	}()
+
+	return nil
+}
+
+// handleHealth answers 200 while the SSH listener is accepting connections,
+// and 503 otherwise, as when the server is stopping.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !s.Ready() {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleMetrics writes the server's Stats in the Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := s.Stats()
+	draining := 0
+	if stats.Draining {
+		draining = 1
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range []struct {
+		name, kind, help string
+		value            int
+	}{
+		{"ssh_chat_clients", "gauge", "Clients connected now.", stats.Connected},
+		{"ssh_chat_clients_peak", "gauge", "The most clients connected at once.", stats.Peak},
+		{"ssh_chat_sessions_total", "counter", "Sessions that have joined the room.", stats.Sessions},
+		{"ssh_chat_unique_keys", "gauge", "Distinct keys that have joined.", stats.UniqueKeys},
+		{"ssh_chat_draining", "gauge", "1 while new connections are refused with /drain.", draining},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+}
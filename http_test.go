@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	server := newTestServer(t)
+	check := func() int {
+		w := httptest.NewRecorder()
+		server.handleHealth(w, httptest.NewRequest("GET", "/healthz", nil))
+		return w.Code
+	}
+
+	if code := check(); code != http.StatusServiceUnavailable {
+		t.Errorf("Got %d before starting", code)
+	}
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if code := check(); code != http.StatusOK {
+		t.Errorf("Got %d once started", code)
+	}
+	server.Stop()
+	if code := check(); code != http.StatusServiceUnavailable {
+		t.Errorf("Got %d after stopping", code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	server := newTestServer(t)
+	server.Add(newTestConnClient(server, "alice", newFakeChannel()))
+
+	w := httptest.NewRecorder()
+	server.handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{"\nssh_chat_clients 1\n", "\nssh_chat_clients_peak 1\n", "# TYPE ssh_chat_sessions_total counter\n"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in:\n%s", want, body)
+		}
+	}
+}
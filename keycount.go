@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// KEY_COUNT_PRECISION is the number of hash bits a KeyCount uses to pick a
+// register. It keeps 2^KEY_COUNT_PRECISION one-byte registers, 4KB, and
+// counts within about 1.6%.
+const KEY_COUNT_PRECISION = 12
+
+// KeyCount estimates how many distinct keys it has been given, in constant
+// memory, as a HyperLogLog. Keys cost nothing to make, so a set of every key
+// seen would grow without bound. Small counts are close to exact. It isn't
+// safe for concurrent use.
+type KeyCount struct {
+	registers [1 << KEY_COUNT_PRECISION]uint8
+}
+
+// Add counts key.
+func (k *KeyCount) Add(key string) {
+	sum := sha1.Sum([]byte(key))
+	hash := binary.BigEndian.Uint64(sum[:8])
+	index := hash >> (64 - KEY_COUNT_PRECISION)
+	// The run of zeros after the index bits, with a bit set at the end so
+	// that it's never longer than what's left.
+	rank := uint8(bits.LeadingZeros64(hash<<KEY_COUNT_PRECISION|1<<(KEY_COUNT_PRECISION-1)) + 1)
+	if rank > k.registers[index] {
+		k.registers[index] = rank
+	}
+}
+
+// Count returns the estimated number of distinct keys added.
+func (k *KeyCount) Count() int {
+	m := float64(len(k.registers))
+	sum, zeros := 0.0, 0
+	for _, rank := range k.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Few keys leave registers empty, and counting those is more
+		// accurate for small counts.
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(estimate))
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestKeyCount(t *testing.T) {
+	k := &KeyCount{}
+	if n := k.Count(); n != 0 {
+		t.Errorf("Empty count is %d", n)
+	}
+
+	for i := 0; i < 100; i++ {
+		k.Add(fmt.Sprintf("fp-%d", i))
+		k.Add(fmt.Sprintf("fp-%d", i))
+	}
+	if n := k.Count(); n != 100 {
+		t.Errorf("Counted %d of 100 keys", n)
+	}
+
+	for i := 100; i < 100000; i++ {
+		k.Add(fmt.Sprintf("fp-%d", i))
+	}
+	if n := k.Count(); n < 95000 || n > 105000 {
+		t.Errorf("Counted %d of 100000 keys", n)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How many missed mentions are kept per user.
+const MAX_MENTIONS = 20
+
+// How long missed mentions, and the names of users who left, are remembered
+// by default.
+const MENTION_TTL = 24 * time.Hour
+
+type departure struct {
+	identity string
+	at       time.Time
+}
+
+// Mentions keeps the messages that mentioned a user while they were away or
+// disconnected, so that they can catch up when they're back. Users are told
+// apart by Client.Identity.
+type Mentions struct {
+	lock     sync.Mutex
+	ttl      time.Duration
+	pending  map[string][]HistoryEntry // identity lookup
+	departed map[string]departure      // name lookup
+
+	// Clock tells the time mentions are kept at and expire by.
+	Clock Clock
+}
+
+func NewMentions() *Mentions {
+	return &Mentions{
+		ttl:      MENTION_TTL,
+		pending:  map[string][]HistoryEntry{},
+		departed: map[string]departure{},
+	}
+}
+
+// SetTTL sets how long mentions, and the names of users who left, are
+// remembered.
+func (m *Mentions) SetTTL(ttl time.Duration) {
+	m.lock.Lock()
+	m.ttl = ttl
+	m.lock.Unlock()
+}
+
+// Add keeps msg for the user with identity, dropping the oldest mention
+// once MAX_MENTIONS are kept.
+func (m *Mentions) Add(identity string, msg string) {
+	m.addAt(identity, msg, m.Clock.Now())
+}
+
+func (m *Mentions) addAt(identity string, msg string, now time.Time) {
+	if identity == "" {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entries := append(m.expire(m.pending[identity], now), HistoryEntry{Time: now, Msg: msg})
+	if len(entries) > MAX_MENTIONS {
+		entries = entries[len(entries)-MAX_MENTIONS:]
+	}
+	m.pending[identity] = entries
+}
+
+// Take returns and forgets the unexpired mentions kept for identity,
+// oldest first.
+func (m *Mentions) Take(identity string) []HistoryEntry {
+	return m.takeAt(identity, m.Clock.Now())
+}
+
+func (m *Mentions) takeAt(identity string, now time.Time) []HistoryEntry {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entries := m.expire(m.pending[identity], now)
+	delete(m.pending, identity)
+	return entries
+}
+
+// Left remembers who had name, so that mentions of it can still be kept for
+// them after they disconnect.
+func (m *Mentions) Left(name string, identity string) {
+	if identity == "" {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.Clock.Now()
+	m.prune(now)
+	m.departed[name] = departure{identity: identity, at: now}
+}
+
+// Joined forgets whoever last left with name, now that someone has it again.
+func (m *Mentions) Joined(name string) {
+	m.lock.Lock()
+	delete(m.departed, name)
+	m.lock.Unlock()
+}
+
+// Departed returns the identity of whoever last left with name, if they
+// left within the TTL.
+func (m *Mentions) Departed(name string) (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	d, ok := m.departed[name]
+	if !ok || m.Clock.Now().Sub(d.at) > m.ttl {
+		return "", false
+	}
+	return d.identity, true
+}
+
+// prune drops expired departures and mentions. Assumes caller holds lock.
+func (m *Mentions) prune(now time.Time) {
+	for name, d := range m.departed {
+		if now.Sub(d.at) > m.ttl {
+			delete(m.departed, name)
+		}
+	}
+	for identity, entries := range m.pending {
+		if entries = m.expire(entries, now); len(entries) == 0 {
+			delete(m.pending, identity)
+		} else {
+			m.pending[identity] = entries
+		}
+	}
+}
+
+// Prune forgets expired departures and mentions.
+func (m *Mentions) Prune() {
+	m.lock.Lock()
+	m.prune(m.Clock.Now())
+	m.lock.Unlock()
+}
+
+// expire returns the entries that are younger than the TTL. Assumes caller
+// holds lock.
+func (m *Mentions) expire(entries []HistoryEntry, now time.Time) []HistoryEntry {
+	for i, entry := range entries {
+		if now.Sub(entry.Time) <= m.ttl {
+			return entries[i:]
+		}
+	}
+	return nil
+}
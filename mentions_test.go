@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMentions(t *testing.T) {
+	m := NewMentions()
+	now := time.Now()
+
+	for i := 0; i < MAX_MENTIONS+5; i++ {
+		m.addAt("fp", fmt.Sprintf("msg %d", i), now)
+	}
+	entries := m.takeAt("fp", now)
+	if len(entries) != MAX_MENTIONS {
+		t.Fatalf("Kept %d mentions, expected %d", len(entries), MAX_MENTIONS)
+	}
+	if entries[0].Msg != "msg 5" {
+		t.Errorf("Oldest kept mention is %q, expected %q", entries[0].Msg, "msg 5")
+	}
+	if entries := m.takeAt("fp", now); len(entries) != 0 {
+		t.Errorf("Got %d mentions after taking them", len(entries))
+	}
+
+	m.addAt("fp", "old", now.Add(-MENTION_TTL-time.Minute))
+	m.addAt("fp", "new", now)
+	entries = m.takeAt("fp", now)
+	if len(entries) != 1 || entries[0].Msg != "new" {
+		t.Errorf("Got %v, expected only the unexpired mention", entries)
+	}
+}
+
+func TestMentionsDeparted(t *testing.T) {
+	m := NewMentions()
+
+	m.Left("bob", "fp-bob")
+	if fingerprint, ok := m.Departed("bob"); !ok || fingerprint != "fp-bob" {
+		t.Errorf("Departed(bob) = %q, %v", fingerprint, ok)
+	}
+	m.Joined("bob")
+	if _, ok := m.Departed("bob"); ok {
+		t.Errorf("bob is still departed after someone joined with the name")
+	}
+}
+
+func TestMentionWhileAway(t *testing.T) {
+	server := newTestServer(t)
+	sender := newTestClient(server, "sender")
+	away := newTestClient(server, "bob")
+	here := newTestClient(server, "alice")
+	away.away = "lunch"
+
+	server.BroadcastMessage(NewChatMsg(sender, "hi @bob and alice"), sender)
+
+	if line := <-here.Msg; strings.HasSuffix(line, BEL) || !strings.Contains(line, "alice") {
+		t.Errorf("Client mentioned without an @ got %q", line)
+	}
+	if entries := server.mentions.Take(away.Fingerprint()); len(entries) != 1 {
+		t.Errorf("Kept %d mentions for the away client, expected 1", len(entries))
+	}
+	if entries := server.mentions.Take(here.Fingerprint()); len(entries) != 0 {
+		t.Errorf("Kept %d mentions for the present client, expected 0", len(entries))
+	}
+
+	server.Leave(away, "")
+	server.BroadcastMessage(NewChatMsg(sender, "bob?"), sender)
+	if entries := server.mentions.Take(away.Fingerprint()); len(entries) != 1 {
+		t.Errorf("Kept %d mentions for the departed client, expected 1", len(entries))
+	}
+}
+
+func TestEmoteMention(t *testing.T) {
+	server := newTestServer(t)
+	sender := newTestClient(server, "alice")
+	bob := newTestClient(server, "bob")
+
+	// The sender gets their own emote back, since it's broadcast to everyone.
+	server.BroadcastMessage(NewEmoteMsg(sender, " waves at @bob, says alice"), nil)
+
+	if line := <-bob.Msg; !strings.HasPrefix(line, "** ") || !strings.HasSuffix(line, BEL) {
+		t.Errorf("Mentioned client got %q", line)
+	}
+	if line := <-sender.Msg; strings.HasSuffix(line, BEL) {
+		t.Errorf("Emote's author was rung: %q", line)
+	}
+}
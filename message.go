@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+type MessageKind int
+
+const (
+	ChatMsg     MessageKind = iota // "name: body"
+	EmoteMsg                       // "** name body"
+	EditMsg                        // "name edited: body", correcting a chat message
+	SystemMsg                      // "* body", announcements to the room
+	PresenceMsg                    // "* body", join/leave/rename notices
+)
+
+// BEL rings the terminal bell of a user mentioned as "@name".
+const BEL = "\a"
+
+var RE_NAME_TOKEN = regexp.MustCompile("[0-9A-Za-z_]+")
+
+// RE_AT_NAME matches an explicit mention, "@name", with the name as its
+// submatch.
+var RE_AT_NAME = regexp.MustCompile("@([0-9A-Za-z_]+)")
+
+// Message is a line broadcast to the room. It's kept structured until it's
+// delivered so that each recipient can render it their own way.
+type Message struct {
+	Kind MessageKind
+	From *Client // nil for system and presence messages
+	Name string  // display name of From at send time
+	Body string
+}
+
+func NewChatMsg(from *Client, body string) *Message {
+	return &Message{Kind: ChatMsg, From: from, Name: from.Server.DisplayName(from), Body: body}
+}
+
+func NewEmoteMsg(from *Client, body string) *Message {
+	return &Message{Kind: EmoteMsg, From: from, Name: from.Server.DisplayName(from), Body: body}
+}
+
+func NewEditMsg(from *Client, body string) *Message {
+	return &Message{Kind: EditMsg, From: from, Name: from.Server.DisplayName(from), Body: body}
+}
+
+// String renders the message without color, as it's kept in the history.
+func (m *Message) String() string {
+	return m.Render(MonochromeTheme)
+}
+
+// Render formats the message using theme.
+func (m *Message) Render(theme *Theme) string {
+	switch m.Kind {
+	case ChatMsg:
+		return fmt.Sprintf("%s: %s", theme.ColorName(m.Name, m.From.Identity()), m.Body)
+	case EmoteMsg:
+		return fmt.Sprintf("** %s%s", theme.ColorName(m.Name, m.From.Identity()), m.Body)
+	case EditMsg:
+		return fmt.Sprintf("%s edited: %s", theme.ColorName(m.Name, m.From.Identity()), m.Body)
+	}
+	return theme.ColorSystem(m.Body)
+}
+
+// Mentions returns the words in the body of a chat message or emote that
+// could be names, each once. "@name" mentions name.
+func (m *Message) Mentions() []string {
+	if m.Kind != ChatMsg && m.Kind != EmoteMsg {
+		return nil
+	}
+	seen := map[string]struct{}{}
+	names := []string{}
+	for _, word := range RE_NAME_TOKEN.FindAllString(m.Body, -1) {
+		if _, ok := seen[word]; ok {
+			continue
+		}
+		seen[word] = struct{}{}
+		names = append(names, word)
+	}
+	return names
+}
+
+// Pings reports whether the body mentions name explicitly, as "@name".
+func (m *Message) Pings(name string) bool {
+	for _, match := range RE_AT_NAME.FindAllStringSubmatch(m.Body, -1) {
+		if match[1] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// RenderMention is like Render, but highlights name in the body, for the
+// user who was mentioned. It also rings their bell if they were mentioned as
+// "@name". Names are whole tokens, so it's matched against RE_NAME_TOKEN
+// rather than a pattern of its own.
+func (m *Message) RenderMention(theme *Theme, name string) string {
+	body := RE_NAME_TOKEN.ReplaceAllStringFunc(m.Body, func(word string) string {
+		if word != name {
+			return word
+		}
+		return theme.ColorHighlight(word)
+	})
+	bell := ""
+	if m.Pings(name) {
+		bell = BEL
+	}
+	if m.Kind == EmoteMsg {
+		return fmt.Sprintf("** %s%s%s", theme.ColorName(m.Name, m.From.Identity()), body, bell)
+	}
+	return fmt.Sprintf("%s: %s%s", theme.ColorName(m.Name, m.From.Identity()), body, bell)
+}
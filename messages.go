@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RE_VERB matches the formatting verbs in a message, like %s and %d.
+var RE_VERB = regexp.MustCompile(`%[-+# 0]*[0-9]*(\.[0-9]*)?[a-zA-Z%]`)
+
+// defaultMessages are the messages sent to clients, in English, by key.
+// --lang translates them and "messages" in the config rewords them. The help
+// for each command is also a message, keyed "help " and the command's name,
+// like "help /nick".
+var defaultMessages = map[string]string{
+	// Rejections.
+	"invalid_command":    "Invalid command: %s",
+	"not_op":             "You're not an admin.",
+	"query_too_fast":     "Slow down.",
+	"missing_args":       "Missing %s from: %s",
+	"too_many_args":      "Too many arguments to %s, expected: %s",
+	"cooldown":           "%s is on cooldown: wait %ds.",
+	"line_too_long":      "Line too long.",
+	"silenced":           "You are silenced for another %s.",
+	"message_rejected":   "Message rejected.",
+	"slow_mode":          "Slow mode: wait %ds.",
+	"message_too_fast":   "Slow down, you're sending messages too fast.",
+	"no_such_name":       "No such name: %s",
+	"no_such_command":    "No such command: %s",
+	"invalid_number":     "Invalid number: %s",
+	"invalid_duration":   "Invalid duration: %s",
+	"invalid_on_off":     "Invalid option: %s (expected on or off)",
+	"no_such_option":     "No such option: %s",
+	"no_such_theme":      "No such theme: %s",
+	"editing_off":        "Editing is turned off.",
+	"nothing_to_edit":    "Nothing to edit, messages can only be edited for %s.",
+	"guest_rename":       "Guests can't change their name.",
+	"too_many_renames":   "You've changed names too many times this session.",
+	"rename_too_fast":    "Slow down, you're changing names too fast.",
+	"name_too_long":      "Name too long (max %d).",
+	"name_not_available": "%s is not available.",
+	"last_op":            "%s is the last op and couldn't be made one again. Make someone else an op first.",
+	"no_key_op":          "%s has no key, so can't be an op.",
+	"missing_reason":     "Missing $REASON from: /away $REASON",
+	"missing_color":      "Missing on or off from: /set color on|off",
+	"missing_compact":    "Missing on or off from: /set compact on|off",
+
+	// System messages and replies.
+	"users_connected":    "%d/%d users connected.",
+	"welcome":            "Welcome to ssh-chat. Enter /help for more.",
+	"connected_as":       "You are connected to %s as %s. Use /nick to change it.",
+	"connected_as_guest": "You are connected to %s as %s.",
+	"motd_header":        "Message of the day for %s:",
+	"no_motd":            "There is no MOTD.",
+	"pinned_header":      "Pinned:",
+	"no_pin":             "Nothing is pinned.",
+	"help_header":        "Available commands:",
+	"help_aliases":       " (also %s)",
+	"help_op":            " (op)",
+	"more_lines":         "%d more lines not shown.",
+	"away":               "You're away: %s. Mentions will be kept until you're /back.",
+	"back":               "Welcome back.",
+	"not_away":           "You're not away.",
+	"idle_away":          "You're idle, so you're marked away until you next type something.",
+	"idle_timeout":       "Disconnected after being idle for %s.",
+	"no_mentions":        "No mentions while you were away.",
+	"nothing_again":      "Nothing to send again.",
+	"renamed_by":         "You were renamed to %s by %s.",
+	"silenced_by":        "Silenced for %s by %s.",
+	"made_op":            "Made op by %s.",
+	"removed_op":         "Removed as op by %s.",
+	"messages_skipped":   "%d messages were skipped, as they came faster than your connection took them.",
+	"missed_mention":     "While you were away, 1 mention:",
+	"missed_mentions":    "While you were away, %d mentions:",
+	"name_taken_renamed": "Your name '%s' is not available, renamed to '%s'. Use /nick <name> to change it.",
+	"replaced_session":   "Reconnected from another session, closing this one.",
+	"name_rules":         "Names can be up to %d letters, digits, and underscores.",
+	"history_cap":        "Only the last %d messages are kept.",
+	"list":               "%d connected: %s",
+	"list_away":          "%s (away)",
+	"notices_shown":      "Notices are shown again.",
+	"notices_hidden":     "Notices are hidden for %s. Replies to your commands are still shown.",
+	"perms_op":           "You are an op, so you can also use: %s",
+	"perms_guest":        "You are a guest, without a key, so you can't change your name or be made an op.",
+	"perms_op_only":      "Only ops can use: %s",
+	"perms_user":         "You are a user. Only ops can use: %s",
+	"pong":               "pong (server time: %s)",
+	"quiet_on":           "Quiet mode is on, join/leave notices are hidden.",
+	"quiet_off":          "Quiet mode is off.",
+	"no_matches":         "No messages matching: %s",
+	"more_matches":       "%d more older matches not shown.",
+	"settings":           "theme: %s, compact: %s",
+	"themes":             "Available themes: %s",
+	"set_theme":          "Set theme: %s",
+	"set_color":          "Set color: %s",
+	"set_compact":        "Set compact: %s",
+	"whois_self":         "You are %s, %s from %s via %s (%s), connected %s, idle %s",
+	"whois":              "%s is %s via %s",
+	"whois_op":           " (operator)",
+	"whois_away":         " (away: %s)",
+	"warned":             "Warned %s.",
+	"edited":             "%s (was: %s)",
+
+	// Replies to op commands.
+	"banned_by":        "Banned by %s.",
+	"banned_by_reason": "Banned by %s: %s.",
+	"banlist_header":   "%d banned:",
+	"banlist_until":    ", until %s",
+	"clients_header":   "%d connected:",
+	"clients_line":     "%s: %s from %s via %s, connected %s, idle %s",
+	"op_not_saved":     "Made %s op, but couldn't save it: %s",
+	"deop_not_saved":   "Removed %s as op, but couldn't save it: %s",
+	"already_draining": "Already draining.",
+	"not_draining":     "Not draining.",
+	"silenced_user":    "Silenced %s for %s.",
+	"slow_mode_on":     "Slow mode is on, one message every %s.",
+	"slow_mode_off":    "Slow mode is off.",
+	"stats_connected":  "%d connected now, at most %d at once.",
+	"stats_sessions":   "%d sessions from %d distinct keys since starting.",
+	"stats_draining":   "Draining, new connections are refused.",
+	"guest_badge":      "Guests can't have badges.",
+	"badge_failed":     "Couldn't give %s a badge: %s",
+	"badge_not_saved":  "Changed the badge of %s, but couldn't save it: %s",
+	"badge_removed":    "Took the badge of %s away.",
+	"badge_given":      "Gave %s the badge [%s].",
+	"nothing_to_pin":   "Nothing to pin.",
+	"pin_failed":       "Couldn't pin that: %s",
+	"pin_not_saved":    "Changed the pin, but couldn't save it: %s",
+	"motd_failed":      "Couldn't change the MOTD: %s",
+	"motd_not_saved":   "Changed the MOTD, but couldn't save it: %s",
+	"motd_cleared":     "Cleared the MOTD.",
+	"motd_now":         "The MOTD is now:",
+
+	// Notices to the room.
+	"joined":               "* %s joined. (Total connected: %d)",
+	"reconnected":          "* %s reconnected.",
+	"reconnected_as":       "* %s reconnected as %s.",
+	"left":                 "* %s left.",
+	"left_reason":          "* %s left (%s).",
+	"renamed":              "* %s is now known as %s.",
+	"banned_notice":        "* %s was banned by %s",
+	"silenced_notice":      "* %s was silenced by %s for %s",
+	"history_cleared":      "* History cleared by %s.",
+	"draining_on":          "* %s is draining the server: no new connections until /drain off.",
+	"draining_off":         "* %s stopped draining, new connections are let in again.",
+	"slow_mode_on_notice":  "* %s turned on slow mode, one message every %s.",
+	"slow_mode_off_notice": "* %s turned off slow mode.",
+	"pinned":               "* %s pinned a message, see /pinned.",
+	"unpinned":             "* %s unpinned the message.",
+}
+
+// defaultMessage returns the English wording for key, if it's known.
+func defaultMessage(key string) (string, bool) {
+	if msg, ok := defaultMessages[key]; ok {
+		return msg, true
+	}
+	if name := strings.TrimPrefix(key, "help "); name != key {
+		if cmd, ok := commands[name]; ok && cmd.Name == name {
+			return cmd.Help, true
+		}
+	}
+	return "", false
+}
+
+// Messages is the wording of the messages sent to clients, with any
+// translations and overrides from the config. It's safe for concurrent use.
+type Messages struct {
+	lock      sync.RWMutex
+	overrides map[string]string
+}
+
+// Get returns the wording for key.
+func (m *Messages) Get(key string) string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if msg, ok := m.overrides[key]; ok {
+		return msg
+	}
+	msg, _ := defaultMessage(key)
+	return msg
+}
+
+// Set replaces the overrides. Each must be for a known key and have the same
+// formatting verbs, in the same order, as the default, or none are set.
+func (m *Messages) Set(overrides map[string]string) error {
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		def, ok := defaultMessage(key)
+		if !ok {
+			return fmt.Errorf("unknown message: %s", key)
+		}
+		if want, got := RE_VERB.FindAllString(def, -1), RE_VERB.FindAllString(overrides[key], -1); !reflect.DeepEqual(want, got) {
+			return fmt.Errorf("message %s must have the verbs %s, like %q", key, strings.Join(want, " "), def)
+		}
+	}
+
+	m.lock.Lock()
+	m.overrides = overrides
+	m.lock.Unlock()
+	return nil
+}
+
+// Text returns the message for key, formatted with args.
+func (s *Server) Text(key string, args ...interface{}) string {
+	return fmt.Sprintf(s.messages.Get(key), args...)
+}
+
+// tell queues the message for key, formatted with args, for the client.
+func (c *Client) tell(key string, args ...interface{}) {
+	c.SysMsg("%s", c.Server.Text(key, args...))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMessages(t *testing.T) {
+	server := newTestServer(t)
+	user := newTestClient(server, "alice")
+
+	commands.Run(user, "/op bob")
+	if got := <-user.Msg; !strings.Contains(got, "You're not an admin.") {
+		t.Errorf("Default wording changed, got %q", got)
+	}
+
+	err := server.messages.Set(map[string]string{"not_op": "Ops only, sorry.", "no_such_name": "Who's %s?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands.Run(user, "/op bob")
+	if got := <-user.Msg; !strings.Contains(got, "Ops only, sorry.") {
+		t.Errorf("Got %q", got)
+	}
+	commands.Run(user, "/whois bob")
+	if got := <-user.Msg; !strings.Contains(got, "Who's bob?") {
+		t.Errorf("Got %q", got)
+	}
+
+	for _, overrides := range []map[string]string{
+		{"no_such_key": "hi"},
+		{"no_such_name": "Nobody by that name."},
+		{"cooldown": "Wait %ds for %s."},
+	} {
+		if err := server.messages.Set(overrides); err == nil {
+			t.Errorf("Expected an error for %v", overrides)
+		}
+	}
+	if got := server.messages.Get("not_op"); got != "Ops only, sorry." {
+		t.Errorf("A bad override replaced the good ones, got %q", got)
+	}
+
+	// Replies to commands and notices to the room are reworded too.
+	err = server.messages.Set(map[string]string{"quiet_on": "Shh.", "left": "%s ist weg."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands.Run(user, "/quiet on")
+	if got := <-user.Msg; !strings.Contains(got, "Shh.") {
+		t.Errorf("Got %q", got)
+	}
+	server.Leave(newTestClient(server, "bob"), "")
+	if entries := server.history.Search("bob ist weg."); len(entries) != 1 {
+		t.Errorf("Leave wasn't reworded: %q", server.history.Get(10))
+	}
+}
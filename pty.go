@@ -4,9 +4,9 @@ package main
 import "encoding/binary"
 
 // parsePtyRequest parses the payload of the pty-req message and extracts the
-// dimensions of the terminal. See RFC 4254, section 6.2.
-func parsePtyRequest(s []byte) (width, height int, ok bool) {
-	_, s, ok = parseString(s)
+// TERM and dimensions of the terminal. See RFC 4254, section 6.2.
+func parsePtyRequest(s []byte) (term string, width, height int, ok bool) {
+	term, s, ok = parseString(s)
 	if !ok {
 		return
 	}
@@ -47,6 +47,17 @@ func parseWinchRequest(s []byte) (width, height int, ok bool) {
 	return
 }
 
+// parseEnvRequest parses the payload of the env message into the variable's
+// name and value. See RFC 4254, section 6.4.
+func parseEnvRequest(s []byte) (name, value string, ok bool) {
+	name, s, ok = parseString(s)
+	if !ok {
+		return
+	}
+	value, _, ok = parseString(s)
+	return
+}
+
 func parseString(in []byte) (out string, rest []byte, ok bool) {
 	if len(in) < 4 {
 		return
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket. It holds up to burst tokens and gains one
+// every interval, and each allowed event spends a token. It's safe for
+// concurrent use, and a nil *RateLimiter allows everything.
+type RateLimiter struct {
+	interval time.Duration
+	burst    float64
+
+	// Clock tells the time tokens are gained by.
+	Clock Clock
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time // when tokens were last gained, zero until first used
+}
+
+// NewRateLimiter returns a full bucket, or nil if interval or burst aren't
+// positive so that the limit is disabled.
+func NewRateLimiter(interval time.Duration, burst int) *RateLimiter {
+	if interval <= 0 || burst <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		interval: interval,
+		burst:    float64(burst),
+		tokens:   float64(burst),
+	}
+}
+
+// Allow spends a token if one is available and reports whether it did.
+func (r *RateLimiter) Allow() bool {
+	if r == nil {
+		return true
+	}
+	return r.allowAt(r.Clock.Now())
+}
+
+// Wait returns how long until a token will be available, or zero if one is.
+func (r *RateLimiter) Wait() time.Duration {
+	if r == nil {
+		return 0
+	}
+	return r.waitAt(r.Clock.Now())
+}
+
+func (r *RateLimiter) waitAt(now time.Time) time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	tokens := r.tokens
+	if elapsed := now.Sub(r.last); elapsed > 0 && !r.last.IsZero() {
+		tokens += float64(elapsed) / float64(r.interval)
+	}
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) * float64(r.interval))
+}
+
+func (r *RateLimiter) allowAt(now time.Time) bool {
+	if r == nil {
+		return true
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.last.IsZero() {
+		// The bucket starts full, so there's nothing to gain yet.
+		r.last = now
+	} else if elapsed := now.Sub(r.last); elapsed > 0 {
+		r.tokens += float64(elapsed) / float64(r.interval)
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+		r.last = now
+	}
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	r := NewRateLimiter(time.Second, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !r.allowAt(now) {
+			t.Errorf("Rejected event %d within burst.", i)
+		}
+	}
+	if r.allowAt(now) {
+		t.Errorf("Allowed event beyond burst.")
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	r := NewRateLimiter(time.Second, 2)
+	now := time.Now()
+
+	r.allowAt(now)
+	r.allowAt(now)
+	if r.allowAt(now.Add(500 * time.Millisecond)) {
+		t.Errorf("Allowed event before a token was refilled.")
+	}
+	if !r.allowAt(now.Add(time.Second)) {
+		t.Errorf("Rejected event after a token was refilled.")
+	}
+
+	// Refilling is capped at the burst size.
+	later := now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !r.allowAt(later) {
+			t.Errorf("Rejected event %d after refilling.", i)
+		}
+	}
+	if r.allowAt(later) {
+		t.Errorf("Refilled beyond burst.")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	r := NewRateLimiter(10*time.Second, 1)
+	now := time.Now()
+
+	if wait := r.waitAt(now); wait != 0 {
+		t.Errorf("Full bucket has to wait %s.", wait)
+	}
+	r.allowAt(now)
+	if wait := r.waitAt(now.Add(4 * time.Second)); wait != 6*time.Second {
+		t.Errorf("Got wait %s, expected 6s.", wait)
+	}
+	if wait := r.waitAt(now.Add(time.Minute)); wait != 0 {
+		t.Errorf("Refilled bucket has to wait %s.", wait)
+	}
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	r := NewRateLimiter(time.Hour, 50)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if r.Allow() {
+					lock.Lock()
+					allowed++
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 50 {
+		t.Errorf("Allowed %d events, expected 50.", allowed)
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	r := NewRateLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if !r.Allow() {
+			t.Fatalf("Disabled limiter rejected an event.")
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// REGISTRY_SHARDS is how many independently locked shards the client
+// registry is split into.
+const REGISTRY_SHARDS = 16
+
+type registryShard struct {
+	lock    sync.RWMutex
+	clients map[string]*Client
+}
+
+// Registry maps names to connected clients. It's split into shards keyed by
+// a hash of the name, each with its own lock, so concurrent lookups and
+// broadcasts in a busy room don't all serialize on a single lock.
+//
+// Each method is atomic on its own, but checking whether a name is free and
+// then claiming it is not, so callers must serialize membership changes.
+type Registry struct {
+	shards []*registryShard
+}
+
+func NewRegistry(shards int) *Registry {
+	r := &Registry{shards: make([]*registryShard, shards)}
+	for i := range r.shards {
+		r.shards[i] = &registryShard{clients: map[string]*Client{}}
+	}
+	return r
+}
+
+func (r *Registry) shard(name string) *registryShard {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return r.shards[h.Sum32()%uint32(len(r.shards))]
+}
+
+func (r *Registry) Get(name string) *Client {
+	shard := r.shard(name)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	return shard.clients[name]
+}
+
+func (r *Registry) Set(name string, client *Client) {
+	shard := r.shard(name)
+	shard.lock.Lock()
+	shard.clients[name] = client
+	shard.lock.Unlock()
+}
+
+func (r *Registry) Delete(name string) {
+	shard := r.shard(name)
+	shard.lock.Lock()
+	delete(shard.clients, name)
+	shard.lock.Unlock()
+}
+
+func (r *Registry) Len() int {
+	n := 0
+	for _, shard := range r.shards {
+		shard.lock.RLock()
+		n += len(shard.clients)
+		shard.lock.RUnlock()
+	}
+	return n
+}
+
+// All returns a snapshot of every client, taking one shard lock at a time.
+func (r *Registry) All() []*Client {
+	clients := make([]*Client, 0, r.Len())
+	for _, shard := range r.shards {
+		shard.lock.RLock()
+		for _, client := range shard.clients {
+			clients = append(clients, client)
+		}
+		shard.lock.RUnlock()
+	}
+	return clients
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry(4)
+	a, b := &Client{Name: "a"}, &Client{Name: "b"}
+
+	r.Set("a", a)
+	r.Set("b", b)
+	if n := r.Len(); n != 2 {
+		t.Errorf("Wrong length: %v", n)
+	}
+	if got := r.Get("a"); got != a {
+		t.Errorf("Got: %v, Expected: %v", got, a)
+	}
+	if n := len(r.All()); n != 2 {
+		t.Errorf("Wrong number of clients: %v", n)
+	}
+
+	r.Delete("a")
+	if got := r.Get("a"); got != nil {
+		t.Errorf("Got: %v, Expected: nil", got)
+	}
+	if n := r.Len(); n != 1 {
+		t.Errorf("Wrong length: %v", n)
+	}
+}
+
+// benchmarkRegistry runs lookups, broadcast snapshots, and joins/leaves
+// concurrently against a registry with 1000 members.
+func benchmarkRegistry(b *testing.B, shards int) {
+	r := NewRegistry(shards)
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("client%d", i)
+		r.Set(names[i], &Client{Name: names[i]})
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			name := names[i%len(names)]
+			switch i % 100 {
+			case 0:
+				r.All()
+			case 1, 2, 3, 4, 5:
+				r.Delete(name)
+				r.Set(name, &Client{Name: name})
+			default:
+				r.Get(name)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkRegistrySingleLock(b *testing.B) { benchmarkRegistry(b, 1) }
+func BenchmarkRegistrySharded(b *testing.B)    { benchmarkRegistry(b, REGISTRY_SHARDS) }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Each responder rule fires at most once per RESPONDER_INTERVAL, so that a
+// trigger can't be used to flood the room.
+const RESPONDER_INTERVAL = 10 * time.Second
+
+// ResponderRule is a trigger and its canned response, as read from the
+// responders file.
+type ResponderRule struct {
+	Match   string `json:"match"`   // regular expression
+	Reply   string `json:"reply"`   // response text
+	Private bool   `json:"private"` // reply to the sender only
+}
+
+type responderRule struct {
+	ResponderRule
+	re      *regexp.Regexp
+	limiter *RateLimiter
+}
+
+// Responder is a bot that answers messages matching its rules, for things
+// like "!rules" without writing a bot.
+type Responder struct {
+	server *Server
+
+	lock  sync.Mutex
+	rules []*responderRule
+}
+
+func NewResponder(server *Server) *Responder {
+	return &Responder{server: server}
+}
+
+// ReadResponders reads the rules from a JSON list in the file at path.
+func ReadResponders(path string) ([]ResponderRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := []ResponderRule{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, rule := range rules {
+		if _, err := regexp.Compile(rule.Match); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return rules, nil
+}
+
+// SetRules replaces the rules. Rules that haven't changed keep their rate
+// limits, so a reload doesn't let them all fire again.
+func (r *Responder) SetRules(rules []ResponderRule) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	limiters := map[ResponderRule]*RateLimiter{}
+	for _, rule := range r.rules {
+		limiters[rule.ResponderRule] = rule.limiter
+	}
+
+	compiled := make([]*responderRule, 0, len(rules))
+	for _, rule := range rules {
+		limiter, ok := limiters[rule]
+		if ok {
+			// A duplicate of the rule gets a limiter of its own.
+			delete(limiters, rule)
+		} else {
+			limiter = r.server.newRateLimiter(RESPONDER_INTERVAL, 1)
+		}
+		compiled = append(compiled, &responderRule{
+			ResponderRule: rule,
+			re:            regexp.MustCompile(rule.Match),
+			limiter:       limiter,
+		})
+	}
+	r.rules = compiled
+}
+
+func (r *Responder) OnMessage(sender *Client, text string) {
+	r.lock.Lock()
+	rules := r.rules
+	r.lock.Unlock()
+
+	for _, rule := range rules {
+		if !rule.re.MatchString(text) || !rule.limiter.Allow() {
+			continue
+		}
+		if !rule.Private {
+			r.server.Broadcast(rule.Reply, nil)
+			continue
+		}
+		sender.deliver(sender.sysLine("%s", rule.Reply))
+	}
+}
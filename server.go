@@ -3,8 +3,10 @@ package main
 import (
 	"crypto/md5"
 	"fmt"
+	"io"
 	"net"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -14,20 +16,196 @@ import (
 
 const MAX_NAME_LENGTH = 32
 const HISTORY_LEN = 20
+const HISTORY_BYTES = 64 * 1024
+const SILENCE_DEFAULT = 5 * time.Minute
+const LOGIN_ATTEMPTS = 5
+const MESSAGE_INTERVAL = time.Second
+const MESSAGE_BURST = 5
+const NICK_INTERVAL = 30 * time.Second
+const NICK_BURST = 3
+const QUERY_INTERVAL = 5 * time.Second
+const QUERY_BURST = 5
+const LOGIN_LOCKOUT = time.Minute
+const VERSION_LENGTH = 100
+const MAX_MOTD_LENGTH = 2048
+const AWAY_AFTER = 10 * time.Minute
+const IDLE_CHECK_INTERVAL = 10 * time.Second
+const BAN_NOTICE_TIMEOUT = 10 * time.Second
+const EDIT_WINDOW = 30 * time.Second
+const FULL_NOTICE = "The server is full, try again later."
+const DRAIN_NOTICE = "The server isn't taking new connections, try again later."
+const REJOIN_WINDOW = 10 * time.Second
+const MAX_BADGE_LENGTH = 12
+const PING_COOLDOWN = 5 * time.Second
+const MAX_BAN_REASON_LENGTH = 100
+const MAX_LEAVE_REASON_LENGTH = 100
+const JANITOR_INTERVAL = 10 * time.Minute
+const COALESCE_MAX = 5
+const DEFAULT_ROOM_NAME = "ssh-chat"
+const MUTE_NOTICES_DEFAULT = 5 * time.Minute
+const MAX_PIN_LENGTH = 1024
+const HANDSHAKE_TIMEOUT = 10 * time.Second
 
 var RE_STRIP_NAME = regexp.MustCompile("[^0-9A-Za-z_]")
 
-type Clients map[string]*Client
+// RESERVED_NAMES are SSH usernames so commonly shared, lowercased, that they're
+// never given to a client on connecting, so that everyone logging in as root
+// doesn't collide. They can still be taken with /nick.
+var RESERVED_NAMES = map[string]bool{
+	"root":   true,
+	"admin":  true,
+	"user":   true,
+	"ubuntu": true,
+	"pi":     true,
+	"guest":  true,
+}
 
 type Server struct {
 	sshConfig *ssh.ServerConfig
 	done      chan struct{}
-	clients   Clients
+	clients   *Registry
 	lock      sync.Mutex
 	count     int
+	guests    int          // telnet and WebSocket guests so far, for naming them
+	botLock   sync.RWMutex // guards handlers and botQueue
+	handlers  []MessageHandler
+	botQueue  chan botMessage
+	responder *Responder // nil until a config has responders, guarded by lock
+	messages  *Messages
+
+	// peak is the most clients connected at once, and seen counts the
+	// distinct keys that have joined, since the server started. Unlike the
+	// fingerprint-keyed maps, seen is never swept, so it's an estimate in
+	// constant memory. Both are guarded by lock.
+	peak int
+	seen KeyCount
+
+	// listening is true while the SSH listener is accepting connections.
+	// It's guarded by lock.
+	listening bool
+
+	// draining is set by /drain to turn new connections away without
+	// disconnecting anyone. It's guarded by lock.
+	draining bool
+
+	// departing holds, by identity, clients whose leave isn't announced
+	// yet. It's guarded by lock.
+	departing map[string]*pendingLeave
+
+	eventLock   sync.RWMutex // guards subscribers and events
+	subscribers []func(Event)
+	events      chan Event
+
 	history   *History
-	admins    map[string]struct{}   // fingerprint lookup
-	banned    map[string]*time.Time // fingerprint lookup
+	mentions  *Mentions
+	admins    map[string]struct{}  // fingerprint lookup, guarded by lock
+	banned    map[string]BannedKey // fingerprint lookup
+	silenced  map[string]time.Time // identity lookup
+	motd      string
+	slowMode  time.Duration // minimum time between messages from non-ops
+	banner    string
+	bannerArt string
+	fileOps   []string // ops from the last applied config, guarded by lock
+	fileBans  []string // bans from the last applied config, guarded by lock
+	opFile    string
+	opFileMu  sync.Mutex // serializes writes to opFile
+	motdFile  string
+	motdMu    sync.Mutex // serializes changes to the MOTD made in the chat
+
+	badges      map[string]string // fingerprint lookup, guarded by lock
+	badgeFile   string
+	badgeFileMu sync.Mutex // serializes writes to badgeFile
+
+	// pin is the message pinned with /pin, shown to everyone who joins. It's
+	// guarded by lock, and kept in pinFile if there is one.
+	pin       string
+	pinFile   string
+	pinFileMu sync.Mutex // serializes writes to pinFile
+
+	// Clock tells the time for silences, bans, idleness, and the other
+	// features that depend on it, including the history, mentions, rate
+	// limits, and Throttle. Tests can replace it to control time.
+	Clock func() time.Time
+
+	// SilenceDefault is how long /silence lasts when no duration is given.
+	SilenceDefault time.Duration
+	// MuteNoticesDefault is how long /mutenotices lasts when no duration is
+	// given.
+	MuteNoticesDefault time.Duration
+	// SilencePublic announces silences to the whole room.
+	SilencePublic bool
+	// Throttle locks out sources that repeatedly fail to log in.
+	Throttle *LoginThrottle
+	// Each client may send a burst of messages, name changes, and queries
+	// like /list and /whois, regaining one every interval. A zero interval
+	// disables the limit. Ops aren't limited in their queries.
+	MessageInterval time.Duration
+	MessageBurst    int
+	NickInterval    time.Duration
+	NickBurst       int
+	QueryInterval   time.Duration
+	QueryBurst      int
+	// RejoinWindow is how long the announcement that a client's connection
+	// dropped is held back. If the same key reconnects in time, neither the
+	// leave nor the join is announced. Zero announces leaves right away.
+	RejoinWindow time.Duration
+	// MaxClients caps how many clients may be connected at once, though ops
+	// can always get in. Zero means no cap.
+	MaxClients int
+	// MaxRenames caps how many times a non-op may change names in one
+	// session. Zero means no cap.
+	MaxRenames int
+	// EditWindow is how long after sending a message it can be corrected
+	// with /edit. Zero disables /edit.
+	EditWindow time.Duration
+	// HandshakeTimeout is how long a new connection has to finish the SSH
+	// handshake before it's dropped. Zero waits for as long as it takes.
+	HandshakeTimeout time.Duration
+	// CoalesceWindow is how long a very short chat line is held back, to be
+	// sent as one message with the short lines that follow it, up to
+	// CoalesceMax of them. Zero sends every line as it comes, as is the
+	// default.
+	CoalesceWindow time.Duration
+	CoalesceMax    int
+	// PersistOps saves ops granted or removed with /op and /deop to the op
+	// file, so that they survive a restart.
+	PersistOps bool
+	// PersistMotd saves changes made with /setmotd and /appendmotd to the
+	// MOTD file.
+	PersistMotd bool
+	// RoomName is what the room is called on joining and above the MOTD.
+	RoomName string
+	// RoomPrompt puts the RoomName in each client's prompt too.
+	RoomPrompt bool
+	// Greeting is sent after the MOTD, with $NAME replaced by the client's
+	// name. An empty greeting is skipped.
+	Greeting string
+	// WSToken is the token WebSocket clients must give to join under a name
+	// of their choosing. With none, they join as guests.
+	WSToken string
+	// WSOrigins are the origins other than the server's own that browsers
+	// may open WebSockets from, or "*" for any.
+	WSOrigins []string
+	// Cooldowns override the cooldowns of commands by name, zero for none.
+	Cooldowns map[string]time.Duration
+	// JanitorInterval is how often expired bans, silences, mentions, and
+	// login failures are cleared out, so that those of users who never
+	// come back don't pile up. Zero leaves them until they're next looked up.
+	JanitorInterval time.Duration
+	// Keepalive is how often clients are sent a keepalive they won't see, for
+	// connections through proxies and NATs that drop quiet ones. It doesn't
+	// count as activity. Zero sends none.
+	Keepalive time.Duration
+	// Clients idle for AwayAfter are marked away until they next send a line,
+	// and those idle for IdleTimeout are disconnected. Zero disables either.
+	AwayAfter   time.Duration
+	IdleTimeout time.Duration
+	// MaxNameLength is the longest name a client can have. Longer names are
+	// truncated on connecting and refused by /nick.
+	MaxNameLength int
+	// VersionLength is how much of a client's version string /whois shows to
+	// non-ops.
+	VersionLength int
 }
 
 func NewServer(privateKey []byte) (*Server, error) {
@@ -37,12 +215,40 @@ func NewServer(privateKey []byte) (*Server, error) {
 	}
 
 	server := Server{
-		done:    make(chan struct{}),
-		clients: Clients{},
-		count:   0,
-		history: NewHistory(HISTORY_LEN),
-		admins:  map[string]struct{}{},
-		banned:  map[string]*time.Time{},
+		done:     make(chan struct{}),
+		clients:  NewRegistry(REGISTRY_SHARDS),
+		count:    0,
+		history:  NewHistory(HISTORY_LEN, HISTORY_BYTES),
+		mentions: NewMentions(),
+		messages: &Messages{},
+		admins:   map[string]struct{}{},
+		banned:   map[string]BannedKey{},
+		silenced: map[string]time.Time{},
+		badges:   map[string]string{},
+
+		departing: map[string]*pendingLeave{},
+
+		Clock:          time.Now,
+		RoomName:       DEFAULT_ROOM_NAME,
+		SilenceDefault: SILENCE_DEFAULT,
+		Throttle:       NewLoginThrottle(LOGIN_ATTEMPTS, LOGIN_LOCKOUT),
+
+		MessageInterval: MESSAGE_INTERVAL,
+		MessageBurst:    MESSAGE_BURST,
+		NickInterval:    NICK_INTERVAL,
+		NickBurst:       NICK_BURST,
+		QueryInterval:   QUERY_INTERVAL,
+		QueryBurst:      QUERY_BURST,
+		VersionLength:   VERSION_LENGTH,
+		MaxNameLength:   MAX_NAME_LENGTH,
+		AwayAfter:       AWAY_AFTER,
+		EditWindow:      EDIT_WINDOW,
+		RejoinWindow:    REJOIN_WINDOW,
+		JanitorInterval: JANITOR_INTERVAL,
+
+		MuteNoticesDefault: MUTE_NOTICES_DEFAULT,
+		CoalesceMax:        COALESCE_MAX,
+		HandshakeTimeout:   HANDSHAKE_TIMEOUT,
 	}
 
 	config := ssh.ServerConfig{
@@ -50,110 +256,532 @@ func NewServer(privateKey []byte) (*Server, error) {
 		// Auth-related things should be constant-time to avoid timing attacks.
 		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 			fingerprint := Fingerprint(key)
-			if server.IsBanned(fingerprint) {
-				return nil, fmt.Errorf("Banned.")
-			}
 			perm := &ssh.Permissions{Extensions: map[string]string{"fingerprint": fingerprint}}
+			if ban, banned := server.lookupBan(fingerprint); banned {
+				// Let the key in, but only so it can be told why it's
+				// turned away. Failing auth looks like a broken server.
+				perm.Extensions["banned"] = banNotice(ban)
+			}
 			return perm, nil
 		},
 	}
+	config.BannerCallback = func(conn ssh.ConnMetadata) string {
+		return server.Banner()
+	}
 	config.AddHostKey(signer)
 
 	server.sshConfig = &config
+	server.history.Clock = server.now
+	server.mentions.Clock = server.now
+	server.Throttle.Clock = server.now
 
 	return &server, nil
 }
 
+// now tells the time by Clock, for the server's parts to follow it even if
+// it's replaced.
+func (s *Server) now() time.Time {
+	return s.Clock()
+}
+
+// newRateLimiter is NewRateLimiter on the server's Clock.
+func (s *Server) newRateLimiter(interval time.Duration, burst int) *RateLimiter {
+	r := NewRateLimiter(interval, burst)
+	if r != nil {
+		r.Clock = s.now
+	}
+	return r
+}
+
+// SetHistoryLimits replaces the history with an empty one holding up to size
+// messages and maxBytes in total.
+func (s *Server) SetHistoryLimits(size int, maxBytes int) {
+	s.history = NewHistory(size, maxBytes)
+	s.history.Clock = s.now
+}
+
+// SetMentionTTL sets how long missed mentions are kept for users who are
+// away or have left.
+func (s *Server) SetMentionTTL(ttl time.Duration) {
+	s.mentions.SetTTL(ttl)
+}
+
 func (s *Server) Len() int {
-	return len(s.clients)
+	return s.clients.Len()
+}
+
+// Stats are counts of the server's use since it started.
+type Stats struct {
+	Connected  int  // clients connected now
+	Peak       int  // the most connected at once
+	Sessions   int  // sessions that have joined the room
+	UniqueKeys int  // distinct keys that have joined
+	Draining   bool // new connections are being refused
+}
+
+// Stats returns the server's counts so far.
+func (s *Server) Stats() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return Stats{
+		Connected:  s.clients.Len(),
+		Peak:       s.peak,
+		Sessions:   s.count,
+		UniqueKeys: s.seen.Count(),
+		Draining:   s.draining,
+	}
 }
 
+// Full reports whether MaxClients are already connected.
+func (s *Server) Full() bool {
+	return s.MaxClients > 0 && s.Len() >= s.MaxClients
+}
+
+// SetDraining turns draining on or off. While draining, new connections are
+// refused and the server isn't Ready, but those already in stay.
+func (s *Server) SetDraining(draining bool) {
+	s.lock.Lock()
+	s.draining = draining
+	s.lock.Unlock()
+}
+
+// Draining reports whether new connections are being refused with /drain.
+func (s *Server) Draining() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.draining
+}
+
+// refusal returns why a new connection should be turned away, or "" to let
+// it in. Ops get in when the server is full, but not while it's draining.
+func (s *Server) refusal(op bool) string {
+	if s.Draining() {
+		return DRAIN_NOTICE
+	}
+	if !op && s.Full() {
+		return FULL_NOTICE
+	}
+	return ""
+}
+
+// Broadcast sends a system announcement to everyone except the given client.
 func (s *Server) Broadcast(msg string, except *Client) {
-	logger.Debugf("Broadcast to %d: %s", s.Len(), msg)
+	s.BroadcastMessage(&Message{Kind: SystemMsg, Body: msg}, except)
+}
+
+// BroadcastPresence is Broadcast for join, leave, and rename notices, which
+// are skipped for clients in quiet mode. Clients that have muted notices miss
+// both.
+func (s *Server) BroadcastPresence(msg string, except *Client) {
+	s.BroadcastMessage(&Message{Kind: PresenceMsg, Body: msg}, except)
+}
+
+// BroadcastMessage renders m for each client except the given one.
+func (s *Server) BroadcastMessage(m *Message, except *Client) {
+	s.BroadcastFiltered(m, Except(except))
+}
+
+// Except returns a filter for BroadcastFiltered that skips the given clients.
+// Nil clients are ignored.
+func Except(clients ...*Client) func(*Client) bool {
+	return func(client *Client) bool {
+		for _, except := range clients {
+			if client == except {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// BroadcastFiltered renders m for each client that include returns true for.
+// It's in the history and seen by bots either way.
+//
+// The registry lock is only held long enough to snapshot the recipients, and
+// sends don't block, so a slow client misses messages rather than stalling
+// everyone else. Clients removed after the snapshot are skipped.
+func (s *Server) BroadcastFiltered(m *Message, include func(*Client) bool) {
+	msg := m.String()
 	s.history.Add(msg)
+	s.notifyHandlers(m)
+
+	clients := s.clients.All()
+
+	logger.Debugf("Broadcast to %d: %s", len(clients), msg)
 
-	for _, client := range s.clients {
-		if except != nil && client == except {
+	mentioned := s.noteMentions(m, msg)
+
+	// Most clients share a handful of themes, so render once per theme.
+	rendered := map[*Theme]string{}
+	for _, client := range clients {
+		if !include(client) {
+			continue
+		}
+		if m.Kind == PresenceMsg && client.PresenceHidden() {
 			continue
 		}
-		client.Msg <- msg
+		if (m.Kind == SystemMsg || m.Kind == PresenceMsg) && client.NoticesMuted() {
+			continue
+		}
+		var line string
+		theme := client.Theme()
+		if _, ok := mentioned[client]; ok {
+			line = m.RenderMention(theme, client.Name)
+		} else if cached, ok := rendered[theme]; ok {
+			line = cached
+		} else {
+			line = m.Render(theme)
+			rendered[theme] = line
+		}
+		if !client.deliver(line) && client.ctx.Err() == nil {
+			logger.Debugf("Dropped message for %s, buffer is full", client.Name)
+		}
 	}
 }
 
-func (s *Server) Add(client *Client) {
-	go func() {
-		client.WriteLines(s.history.Get(10))
-		client.Write(fmt.Sprintf("-> Welcome to ssh-chat. Enter /help for more."))
-	}()
+// noteMentions returns the connected clients mentioned by m, and keeps msg
+// for each mentioned user who is away or has left.
+func (s *Server) noteMentions(m *Message, msg string) map[*Client]struct{} {
+	mentioned := map[*Client]struct{}{}
+	for _, name := range m.Mentions() {
+		client := s.clients.Get(name)
+		if client == nil {
+			if identity, ok := s.mentions.Departed(name); ok {
+				s.mentions.Add(identity, msg)
+			}
+			continue
+		}
+		if client == m.From {
+			continue
+		}
+		mentioned[client] = struct{}{}
+		if client.IsAway() {
+			s.mentions.Add(client.Identity(), msg)
+		}
+	}
+	return mentioned
+}
+
+// motdLines returns motd as lines for client, under a header naming the room.
+func (s *Server) motdLines(client *Client, motd string) []string {
+	return append([]string{client.sysLine("%s", s.Text("motd_header", s.RoomName))}, strings.Split(motd, "\n")...)
+}
 
+// Welcome writes the banner art, recent history, and MOTD to a client that
+// just joined, unless it sent CHAT_QUIET_ENV. It writes straight to the
+// terminal, so it should be called before the client's Msg writer starts.
+// That way a long replay can't fill the Msg buffer and stall anyone, and live
+// messages queue up behind it rather than interleaving with it.
+func (s *Server) Welcome(client *Client) {
+	if !client.Quiet() {
+		s.replay(client)
+	}
+	if s.MaxClients > 0 {
+		client.SysWrite("%s", s.Text("users_connected", s.Len(), s.MaxClients))
+	}
+	if s.Greeting != "" {
+		client.SysWrite("%s", strings.Replace(s.Greeting, "$NAME", printable(client.Name), -1))
+	}
+	client.SysWrite("%s", s.Text("welcome"))
+	if client.guest {
+		client.SysWrite("%s", s.Text("connected_as_guest", s.RoomName, client.Name))
+	} else {
+		client.SysWrite("%s", s.Text("connected_as", s.RoomName, client.Name))
+	}
+	if entries := s.mentions.Take(client.Identity()); len(entries) > 0 {
+		client.SysWrite("%s", s.missedMentions(len(entries)))
+		for _, entry := range entries {
+			client.Write(entry.String())
+		}
+	}
+}
+
+// replay writes the banner art, recent history, MOTD, and pinned message to
+// client.
+func (s *Server) replay(client *Client) {
+	if art := s.BannerArt(); art != "" {
+		client.WriteLines(strings.Split(art, "\n"))
+	}
+	client.WriteLines(s.history.Get(10))
+	if motd := s.Motd(); motd != "" {
+		client.WriteLines(s.motdLines(client, motd))
+	}
+	if pin := s.Pin(); pin != "" {
+		client.WriteLines(s.pinLines(client, pin))
+	}
+}
+
+func (s *Server) Add(client *Client) {
 	s.lock.Lock()
 	s.count++
 
+	// If the same key reconnects while its old session is still lingering,
+	// hand the name over to the new session rather than treating it as taken.
+	stale := s.sessionOf(client)
+	if stale != nil {
+		s.clients.Delete(stale.Name)
+	}
+
+	if until, ok := s.silenced[client.Identity()]; ok {
+		if until.After(s.Clock()) {
+			client.silenceUntil(until)
+		} else {
+			delete(s.silenced, client.Identity())
+		}
+	}
+
 	newName, err := s.proposeName(client.Name)
+	if err == nil && RESERVED_NAMES[strings.ToLower(newName)] {
+		err = fmt.Errorf(s.messages.Get("name_not_available"), newName)
+	}
 	if err != nil {
-		client.Msg <- fmt.Sprintf("-> Your name '%s' is not available, renamed to '%s'. Use /nick <name> to change it.", client.Name, newName)
+		newName = s.guestName(client)
+		client.tell("name_taken_renamed", client.Name, newName)
 	}
 
-	client.Rename(newName)
-	s.clients[client.Name] = client
-	num := len(s.clients)
+	client.Name = newName
+	s.clients.Set(client.Name, client)
+	s.mentions.Joined(client.Name)
+	num := s.clients.Len()
+	if num > s.peak {
+		s.peak = num
+	}
+	if fingerprint := client.Fingerprint(); fingerprint != "" {
+		s.seen.Add(fingerprint)
+	}
+	var rejoined *pendingLeave
+	if d, ok := s.departing[client.Identity()]; ok && d.timer.Stop() {
+		delete(s.departing, client.Identity())
+		rejoined = d
+	}
 	s.lock.Unlock()
+	client.showPrompt()
+
+	if stale != nil {
+		s.emit(newEvent(EventDisconnected, stale))
+	}
+	s.emit(newEvent(EventShellStarted, client))
 
-	s.Broadcast(fmt.Sprintf("* %s joined. (Total connected: %d)", client.Name, num), client)
+	if stale != nil {
+		logger.Infof("Replacing stale session for %s", client.Name)
+		stale.SysWrite("%s", s.Text("replaced_session"))
+		stale.Conn.Close()
+		if stale.Name != client.Name {
+			s.BroadcastPresence(s.Text("reconnected_as", stale.Name, client.Name), client)
+			return
+		}
+		s.BroadcastPresence(s.Text("reconnected", client.Name), client)
+		return
+	}
+	if rejoined != nil {
+		// The room never heard about the drop, so only a new name is news.
+		if rejoined.name != client.Name {
+			s.BroadcastPresence(s.Text("reconnected_as", rejoined.name, client.Name), client)
+		}
+		return
+	}
+
+	s.BroadcastPresence(s.Text("joined", client.Name, num), client)
+}
+
+// sessionOf returns the session already connected with client's key, or nil.
+// It's looked for under the name client asked for first, and then under any
+// name, as the old session may have been given a guest name or renamed.
+func (s *Server) sessionOf(client *Client) *Client {
+	fingerprint := client.Fingerprint()
+	if fingerprint == "" {
+		return nil
+	}
+	if other := s.clients.Get(s.cleanName(client.Name)); other != nil && other.Fingerprint() == fingerprint {
+		return other
+	}
+	for _, other := range s.clients.All() {
+		if other.Fingerprint() == fingerprint {
+			return other
+		}
+	}
+	return nil
 }
 
+// Remove removes client after its connection ended without it leaving on
+// purpose. Its leave is held back for RejoinWindow, in case it comes back.
 func (s *Server) Remove(client *Client) {
+	s.leave(client, "", true)
+}
+
+// Leave removes client and announces its departure right away, including
+// reason if one is given. The client's context is cancelled to stop its
+// goroutines. It is a no-op if client was already removed.
+func (s *Server) Leave(client *Client, reason string) {
+	s.leave(client, reason, false)
+}
+
+// leave removes client, announcing it after RejoinWindow if it dropped, or
+// right away otherwise.
+func (s *Server) leave(client *Client, reason string, dropped bool) {
+	client.cancel()
+
+	s.lock.Lock()
+	if s.clients.Get(client.Name) != client {
+		// Already removed, or replaced by a reconnecting session.
+		s.lock.Unlock()
+		return
+	}
+	s.clients.Delete(client.Name)
+	empty := s.clients.Len() == 0
+	identity := client.Identity()
+	s.mentions.Left(client.Name, identity)
+	if dropped && !client.guest && s.RejoinWindow > 0 {
+		// Give it a moment to come back before saying so. Guests get a new
+		// name each time, so they can't be recognized coming back.
+		if d, ok := s.departing[identity]; ok {
+			d.timer.Stop()
+		}
+		d := &pendingLeave{name: client.Name}
+		d.timer = time.AfterFunc(s.RejoinWindow, func() { s.announceLeave(identity, d) })
+		s.departing[identity] = d
+		s.lock.Unlock()
+		s.emitLeave(client, empty)
+		return
+	}
+	s.lock.Unlock()
+	s.emitLeave(client, empty)
+
+	if reason != "" {
+		s.BroadcastPresence(s.Text("left_reason", client.Name, reason), nil)
+		return
+	}
+	s.BroadcastPresence(s.Text("left", client.Name), nil)
+}
+
+// emitLeave emits the events for client leaving, and for the room emptying if
+// it was the last to go.
+func (s *Server) emitLeave(client *Client, empty bool) {
+	s.emit(newEvent(EventDisconnected, client))
+	if empty {
+		s.emit(newEvent(EventRoomEmpty, client))
+	}
+}
+
+// pendingLeave is a client whose connection dropped, waiting to see if it
+// reconnects before its leave is announced.
+type pendingLeave struct {
+	name  string
+	timer *time.Timer
+}
+
+// announceLeave announces d once the rejoin window has passed without the
+// client coming back.
+func (s *Server) announceLeave(identity string, d *pendingLeave) {
 	s.lock.Lock()
-	delete(s.clients, client.Name)
+	if s.departing[identity] == d {
+		delete(s.departing, identity)
+	}
 	s.lock.Unlock()
+	s.BroadcastPresence(s.Text("left", d.name), nil)
+}
 
-	s.Broadcast(fmt.Sprintf("* %s left.", client.Name), nil)
+// cleanName strips disallowed characters from name and truncates it to
+// MaxNameLength.
+func (s *Server) cleanName(name string) string {
+	name = RE_STRIP_NAME.ReplaceAllString(name, "")
+	if len(name) > s.MaxNameLength {
+		name = name[:s.MaxNameLength]
+	}
+	return name
+}
+
+// guestName returns a name for a client whose own is taken or reserved. For
+// a client with a key it's derived from the fingerprint, so it's the same
+// from one session to the next, unless that's taken too. Assumes the caller
+// holds lock.
+func (s *Server) guestName(client *Client) string {
+	if fingerprint := client.Fingerprint(); fingerprint != "" {
+		hash := md5.Sum([]byte(fingerprint))
+		name := s.cleanName(fmt.Sprintf("guest_%x", hash[:4]))
+		if s.clients.Get(name) == nil {
+			return name
+		}
+	}
+	return fmt.Sprintf("Guest%d", s.count)
 }
 
 func (s *Server) proposeName(name string) (string, error) {
 	// Assumes caller holds lock.
 	var err error
-	name = RE_STRIP_NAME.ReplaceAllString(name, "")
+	name = s.cleanName(name)
 
-	if len(name) > MAX_NAME_LENGTH {
-		name = name[:MAX_NAME_LENGTH]
-	} else if len(name) == 0 {
+	if len(name) == 0 {
 		name = fmt.Sprintf("Guest%d", s.count)
 	}
 
-	_, collision := s.clients[name]
-	if collision {
-		err = fmt.Errorf("%s is not available.", name)
+	if s.clients.Get(name) != nil {
+		err = fmt.Errorf(s.messages.Get("name_not_available"), name)
 		name = fmt.Sprintf("Guest%d", s.count)
 	}
 
 	return name, err
 }
 
+// Rename changes client's name to newName, if it's available. Unlike names
+// given on connecting, which are truncated, a name that's too long is
+// refused.
 func (s *Server) Rename(client *Client, newName string) {
+	if _, err := s.rename(client, newName); err != nil {
+		client.SysMsg("%s", err)
+		return
+	}
+	client.renameCount++
+}
+
+// ForceRename is Rename by an op, for a user who won't change a name
+// themselves. It doesn't count towards the user's MaxRenames, and returns
+// the name they were given.
+func (s *Server) ForceRename(client *Client, newName string) (string, error) {
+	return s.rename(client, newName)
+}
+
+func (s *Server) rename(client *Client, newName string) (string, error) {
+	if len(RE_STRIP_NAME.ReplaceAllString(newName, "")) > s.MaxNameLength {
+		return "", fmt.Errorf(s.messages.Get("name_too_long"), s.MaxNameLength)
+	}
+
 	s.lock.Lock()
 
 	newName, err := s.proposeName(newName)
 	if err != nil {
-		client.Msg <- fmt.Sprintf("-> %s", err)
 		s.lock.Unlock()
-		return
+		return "", err
 	}
 
 	// TODO: Use a channel/goroutine for adding clients, rathern than locks?
-	delete(s.clients, client.Name)
+	s.clients.Delete(client.Name)
 	oldName := client.Name
-	client.Rename(newName)
-	s.clients[client.Name] = client
+	client.Name = newName
+	s.clients.Set(client.Name, client)
+	s.mentions.Joined(client.Name)
 	s.lock.Unlock()
+	client.showPrompt()
 
-	s.Broadcast(fmt.Sprintf("* %s is now known as %s.", oldName, newName), nil)
+	event := newEvent(EventRenamed, client)
+	event.OldName = oldName
+	s.emit(event)
+	s.BroadcastPresence(s.Text("renamed", oldName, newName), nil)
+	return newName, nil
+}
+
+// Clients returns the connected clients, sorted by name.
+func (s *Server) Clients() []*Client {
+	clients := s.clients.All()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	return clients
 }
 
 func (s *Server) List(prefix *string) []string {
 	r := []string{}
 
-	for name, _ := range s.clients {
+	for _, client := range s.clients.All() {
+		name := client.Name
 		if prefix != nil && !strings.HasPrefix(name, *prefix) {
 			continue
 		}
@@ -164,7 +792,7 @@ func (s *Server) List(prefix *string) []string {
 }
 
 func (s *Server) Who(name string) *Client {
-	return s.clients[name]
+	return s.clients.Get(name)
 }
 
 func (s *Server) Op(fingerprint string) {
@@ -174,34 +802,274 @@ func (s *Server) Op(fingerprint string) {
 	s.lock.Unlock()
 }
 
-func (s *Server) IsOp(client *Client) bool {
-	_, r := s.admins[client.Fingerprint()]
-	return r
+func (s *Server) Deop(fingerprint string) {
+	logger.Infof("Removing admin: %s", fingerprint)
+	s.lock.Lock()
+	delete(s.admins, fingerprint)
+	s.lock.Unlock()
 }
 
-func (s *Server) IsBanned(fingerprint string) bool {
-	ban, hasBan := s.banned[fingerprint]
-	if !hasBan {
+// isLastOp reports whether fingerprint is the only op, with no way back if
+// it's deopped, or banned if deop isn't set. A deopped op from the config or
+// op file comes back on the next SIGHUP or restart, unless PersistOps would
+// remove it from the op file too. A ban has no way back either way: it
+// outlasts a reload, and banned keys are turned away before they're opped.
+func (s *Server) isLastOp(fingerprint string, deop bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, op := s.admins[fingerprint]; !op || len(s.admins) > 1 {
 		return false
 	}
-	if ban == nil {
+	if !deop || !contains(s.fileOps, fingerprint) {
 		return true
 	}
-	if ban.Before(time.Now()) {
-		s.Unban(fingerprint)
+	return s.PersistOps && s.opFile != ""
+}
+
+// SaveOp adds or removes fingerprint in the op file, if PersistOps is set and
+// there is one. Clients without a key have no fingerprint to save.
+func (s *Server) SaveOp(fingerprint string, op bool) error {
+	if fingerprint == "" {
+		return fmt.Errorf("no key to save")
+	}
+	s.lock.Lock()
+	path := s.opFile
+	s.lock.Unlock()
+	if !s.PersistOps || path == "" {
+		return nil
+	}
+
+	s.opFileMu.Lock()
+	defer s.opFileMu.Unlock()
+	return updateFingerprints(path, fingerprint, op)
+}
+
+// IsOp reports whether client is an op. Guests and WebSocket clients have no
+// key, so they never are.
+func (s *Server) IsOp(client *Client) bool {
+	if client.guest {
 		return false
 	}
-	return true
+	return s.isOpKey(client.Fingerprint())
 }
 
-func (s *Server) Ban(fingerprint string, duration *time.Duration) {
-	var until *time.Time
+// isOpKey reports whether fingerprint is an op's.
+func (s *Server) isOpKey(fingerprint string) bool {
+	if fingerprint == "" {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, r := s.admins[fingerprint]
+	return r
+}
+
+// DisplayName is the name used when broadcasting messages from client.
+// Operators are marked with an "@" prefix, and a badge goes before that, as
+// in "[VIP] @alice".
+func (s *Server) DisplayName(client *Client) string {
+	name := client.Name
+	if s.IsOp(client) {
+		name = "@" + name
+	}
+	if badge := s.Badge(client); badge != "" {
+		name = "[" + badge + "] " + name
+	}
+	return name
+}
+
+// Cooldown returns how long a non-op must wait between uses of cmd.
+func (s *Server) Cooldown(cmd *Command) time.Duration {
+	if cooldown, ok := s.Cooldowns[cmd.Name]; ok {
+		return cooldown
+	}
+	return cmd.Cooldown
+}
+
+// Badge returns the badge given to client's key, if any.
+func (s *Server) Badge(client *Client) string {
+	if client.guest || client.Fingerprint() == "" {
+		return ""
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.badges[client.Fingerprint()]
+}
+
+// SetBadge gives the key fingerprint a badge, or takes it away if badge is
+// empty. Badges are shown to everyone, so all but letters, digits, and
+// underscores are stripped. It returns the badge as it will be shown.
+func (s *Server) SetBadge(fingerprint string, badge string) (string, error) {
+	if badge != "" {
+		badge = RE_STRIP_NAME.ReplaceAllString(badge, "")
+		if badge == "" {
+			return "", fmt.Errorf("a badge needs letters or digits")
+		}
+		if len(badge) > MAX_BADGE_LENGTH {
+			return "", fmt.Errorf("a badge can be at most %d characters", MAX_BADGE_LENGTH)
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if badge == "" {
+		delete(s.badges, fingerprint)
+	} else {
+		s.badges[fingerprint] = badge
+	}
+	return badge, nil
+}
+
+// SaveBadges writes the badges to the badge file, if there is one.
+func (s *Server) SaveBadges() error {
+	s.badgeFileMu.Lock()
+	defer s.badgeFileMu.Unlock()
+
+	s.lock.Lock()
+	path := s.badgeFile
+	badges := make(map[string]string, len(s.badges))
+	for fingerprint, badge := range s.badges {
+		badges[fingerprint] = badge
+	}
+	s.lock.Unlock()
+	if path == "" {
+		return nil
+	}
+	return writeBadges(path, badges)
+}
+
+// Silence silences client for duration, remembering it by identity so that
+// reconnecting doesn't clear it.
+func (s *Server) Silence(client *Client, duration time.Duration) {
+	until := client.Silence(duration)
+	s.lock.Lock()
+	s.silenced[client.Identity()] = until
+	s.lock.Unlock()
+}
+
+func (s *Server) IsBanned(fingerprint string) bool {
+	_, banned := s.BanExpiry(fingerprint)
+	return banned
+}
+
+// BanExpiry reports whether fingerprint is banned and until when, with a nil
+// time for a ban that doesn't expire.
+func (s *Server) BanExpiry(fingerprint string) (*time.Time, bool) {
+	ban, banned := s.lookupBan(fingerprint)
+	return ban.Until, banned
+}
+
+// BannedKey is a ban on a key.
+type BannedKey struct {
+	Fingerprint string
+	Until       *time.Time // nil if the ban doesn't expire
+	Reason      string     // empty if none was given
+}
+
+// lookupBan returns the ban on fingerprint, if there is one, forgetting it
+// if it has expired.
+func (s *Server) lookupBan(fingerprint string) (BannedKey, bool) {
+	s.lock.Lock()
+	ban, banned := s.banned[fingerprint]
+	s.lock.Unlock()
+	if !banned {
+		return BannedKey{}, false
+	}
+	if ban.Until != nil && ban.Until.Before(s.Clock()) {
+		s.Unban(fingerprint)
+		return BannedKey{}, false
+	}
+	return ban, true
+}
+
+// Bans returns the bans that haven't expired, sorted by fingerprint.
+func (s *Server) Bans() []BannedKey {
+	s.lock.Lock()
+	fingerprints := make([]string, 0, len(s.banned))
+	for fingerprint := range s.banned {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	s.lock.Unlock()
+	sort.Strings(fingerprints)
+
+	bans := []BannedKey{}
+	for _, fingerprint := range fingerprints {
+		if ban, banned := s.lookupBan(fingerprint); banned {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+// banNotice is what a client is told when it's turned away by ban.
+func banNotice(ban BannedKey) string {
+	notice := "You are banned from this server"
+	if ban.Until != nil {
+		notice += " until " + ban.Until.UTC().Format(time.RFC1123)
+	}
+	if ban.Reason != "" {
+		notice += ": " + ban.Reason
+	}
+	return notice + "."
+}
+
+// rejectSession writes notice to the first session a client that's being
+// turned away opens, and then disconnects it. Clients that don't open one in
+// time are dropped.
+func rejectSession(conn io.Closer, channels <-chan ssh.NewChannel, notice string) {
+	defer conn.Close()
+
+	timeout := time.After(BAN_NOTICE_TIMEOUT)
+	for {
+		select {
+		case ch, ok := <-channels:
+			if !ok {
+				return
+			}
+			if t := ch.ChannelType(); t != "session" {
+				ch.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
+				continue
+			}
+			channel, requests, err := ch.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// Accept the pty and shell, so the client shows the notice
+				// rather than an error about its session.
+				for req := range requests {
+					if req.WantReply {
+						req.Reply(req.Type == "pty-req" || req.Type == "shell", nil)
+					}
+				}
+			}()
+			fmt.Fprintf(channel, "-> %s\r\n", notice)
+			channel.Close()
+			return
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// Ban bans the key fingerprint, for duration or for good if it's nil. The
+// reason is shown to the client when it's turned away, and listed by
+// /banlist, so it's sanitized and truncated.
+func (s *Server) Ban(fingerprint string, duration *time.Duration, reason string) {
+	if fingerprint == "" {
+		// Guests have no key to ban, banning one only disconnects them.
+		return
+	}
+	ban := BannedKey{
+		Fingerprint: fingerprint,
+		Reason:      truncate(printable(RE_ESCAPE.ReplaceAllString(reason, "")), MAX_BAN_REASON_LENGTH),
+	}
 	s.lock.Lock()
 	if duration != nil {
-		when := time.Now().Add(*duration)
-		until = &when
+		until := s.Clock().Add(*duration)
+		ban.Until = &until
 	}
-	s.banned[fingerprint] = until
+	s.banned[fingerprint] = ban
 	s.lock.Unlock()
 }
 
@@ -211,6 +1079,256 @@ func (s *Server) Unban(fingerprint string) {
 	s.lock.Unlock()
 }
 
+func (s *Server) Motd() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.motd
+}
+
+func (s *Server) SetMotd(motd string) {
+	s.lock.Lock()
+	s.motd = motd
+	s.lock.Unlock()
+}
+
+// SlowMode returns the minimum time between messages from each non-op, or 0
+// if slow mode is off.
+func (s *Server) SlowMode() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.slowMode
+}
+
+func (s *Server) SetSlowMode(interval time.Duration) {
+	s.lock.Lock()
+	s.slowMode = interval
+	s.lock.Unlock()
+}
+
+// EditMotd replaces the MOTD with text, or adds text to the end of it as a new
+// line, and returns the result. "\n" in text starts a new line. Escapes and
+// control characters are removed, since everyone sees the MOTD.
+func (s *Server) EditMotd(text string, add bool) (string, error) {
+	lines := strings.Split(strings.Replace(text, `\n`, "\n", -1), "\n")
+	for i, line := range lines {
+		lines[i] = printable(RE_ESCAPE.ReplaceAllString(line, ""))
+	}
+	text = strings.Join(lines, "\n")
+
+	s.motdMu.Lock()
+	defer s.motdMu.Unlock()
+
+	motd := text
+	if current := s.Motd(); add && current != "" {
+		motd = current + "\n" + text
+	}
+	if len(motd) > MAX_MOTD_LENGTH {
+		return "", fmt.Errorf("the MOTD can be at most %d bytes", MAX_MOTD_LENGTH)
+	}
+	s.SetMotd(motd)
+	return motd, nil
+}
+
+// SaveMotd writes the MOTD to the MOTD file, if PersistMotd is set and there
+// is one.
+func (s *Server) SaveMotd() error {
+	s.lock.Lock()
+	path := s.motdFile
+	s.lock.Unlock()
+	if !s.PersistMotd || path == "" {
+		return nil
+	}
+
+	s.motdMu.Lock()
+	defer s.motdMu.Unlock()
+	motd := s.Motd()
+	if motd != "" {
+		motd += "\n"
+	}
+	return writeFile(path, motd)
+}
+
+// Pin returns the pinned message, or "" if nothing is pinned.
+func (s *Server) Pin() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pin
+}
+
+// SetPin pins text, or unpins the message if text is empty, and returns the
+// message as it will be shown. As with the MOTD, "\n" in text starts a new
+// line, and escapes and control characters are removed.
+func (s *Server) SetPin(text string) (string, error) {
+	lines := strings.Split(strings.Replace(text, `\n`, "\n", -1), "\n")
+	for i, line := range lines {
+		lines[i] = printable(RE_ESCAPE.ReplaceAllString(line, ""))
+	}
+	text = strings.TrimSpace(strings.Join(lines, "\n"))
+	if len(text) > MAX_PIN_LENGTH {
+		return "", fmt.Errorf("a pinned message can be at most %d bytes", MAX_PIN_LENGTH)
+	}
+
+	s.lock.Lock()
+	s.pin = text
+	s.lock.Unlock()
+	return text, nil
+}
+
+// SavePin writes the pinned message to the pin file, if there is one.
+func (s *Server) SavePin() error {
+	s.pinFileMu.Lock()
+	defer s.pinFileMu.Unlock()
+
+	s.lock.Lock()
+	path, pin := s.pinFile, s.pin
+	s.lock.Unlock()
+	if path == "" {
+		return nil
+	}
+	if pin != "" {
+		pin += "\n"
+	}
+	return writeFile(path, pin)
+}
+
+// pinLines is the pinned message as shown to client.
+func (s *Server) pinLines(client *Client, pin string) []string {
+	return append([]string{client.sysLine("%s", s.Text("pinned_header"))}, strings.Split(pin, "\n")...)
+}
+
+// Banner returns the pre-auth banner shown by SSH clients before login.
+func (s *Server) Banner() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.banner
+}
+
+// SetBanner sets the pre-auth banner. It's prefixed with the RoomName and
+// line endings are normalized since clients print it as-is. An empty banner
+// disables it.
+func (s *Server) SetBanner(banner string) {
+	if banner != "" {
+		banner = s.RoomName + "\n\n" + banner + "\n"
+		banner = strings.Replace(banner, "\r\n", "\n", -1)
+		banner = strings.Replace(banner, "\n", "\r\n", -1)
+	}
+	s.lock.Lock()
+	s.banner = banner
+	s.lock.Unlock()
+}
+
+// BannerArt returns the ASCII art sent to clients as they connect.
+func (s *Server) BannerArt() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.bannerArt
+}
+
+func (s *Server) SetBannerArt(art string) {
+	s.lock.Lock()
+	s.bannerArt = art
+	s.lock.Unlock()
+}
+
+// Configure applies the reloadable subset of config: the MOTD, banners, ops,
+// bans, badges, and responders, including ops and bans from the op and ban
+// files. Ops and bans from a previously applied config that are no longer
+// listed are revoked, while those made at runtime are left alone. Badges are
+// replaced by those in the badge file, if there is one.
+func (s *Server) Configure(config *Config) error {
+	motd, err := config.ReadMotd()
+	if err != nil {
+		return err
+	}
+	banner, err := config.ReadBanner()
+	if err != nil {
+		return err
+	}
+	ops, err := config.Ops()
+	if err != nil {
+		return err
+	}
+	bans, err := config.Bans()
+	if err != nil {
+		return err
+	}
+	badges, err := config.Badges()
+	if err != nil {
+		return err
+	}
+	pin, err := config.ReadPin()
+	if err != nil {
+		return err
+	}
+	var rules []ResponderRule
+	if config.Responders != "" {
+		rules, err = ReadResponders(config.Responders)
+		if err != nil {
+			return err
+		}
+	}
+	messages, err := config.ReadMessages()
+	if err != nil {
+		return err
+	}
+	if err := s.messages.Set(messages); err != nil {
+		return err
+	}
+
+	s.SetMotd(motd)
+	s.SetBanner(banner)
+	s.SetBannerArt(config.ReadBannerArt())
+	s.lock.Lock()
+	fileOps, fileBans := s.fileOps, s.fileBans
+	s.lock.Unlock()
+	for _, fingerprint := range fileOps {
+		if !contains(ops, fingerprint) {
+			s.Deop(fingerprint)
+		}
+	}
+	for _, fingerprint := range fileBans {
+		if !contains(bans, fingerprint) {
+			s.Unban(fingerprint)
+		}
+	}
+	for _, fingerprint := range ops {
+		s.Op(fingerprint)
+	}
+	for _, fingerprint := range bans {
+		// Keep the reason and expiry of a ban made with /ban.
+		if !s.IsBanned(fingerprint) {
+			s.Ban(fingerprint, nil, "")
+		}
+	}
+	s.lock.Lock()
+	s.fileOps, s.fileBans = ops, bans
+	responder, added := s.responder, false
+	if rules != nil && responder == nil {
+		responder, added = NewResponder(s), true
+		s.responder = responder
+	}
+	s.opFile = config.OpFile
+	s.motdFile = config.Motd
+	s.badgeFile = config.BadgeFile
+	if badges != nil {
+		s.badges = badges
+	}
+	s.pinFile = config.PinFile
+	if config.PinFile != "" {
+		s.pin = pin
+	}
+	s.lock.Unlock()
+	if added {
+		s.AddHandler(responder)
+	}
+	if responder != nil {
+		responder.SetRules(rules)
+	}
+
+	logger.Infof("Configured %d ops, %d bans, %d responders, and a %d byte MOTD.", len(ops), len(bans), len(rules), len(motd))
+	return nil
+}
+
 func (s *Server) Start(laddr string) error {
 	// Once a ServerConfig has been configured, connections can be
 	// accepted.
@@ -220,8 +1338,10 @@ func (s *Server) Start(laddr string) error {
 	}
 
 	logger.Infof("Listening on %s", laddr)
+	s.setListening(true)
 
 	go func() {
+		defer s.setListening(false)
 		for {
 			conn, err := socket.Accept()
 
@@ -232,25 +1352,7 @@ func (s *Server) Start(laddr string) error {
 			}
 
 			// Goroutineify to resume accepting sockets early.
-			go func() {
-				// From a standard TCP connection to an encrypted SSH connection
-				sshConn, channels, requests, err := ssh.NewServerConn(conn, s.sshConfig)
-				if err != nil {
-					logger.Errorf("Failed to handshake: %v", err)
-					return
-				}
-
-				version := sshConn.ClientVersion()
-				if len(version) > 100 {
-					version = []byte("Evil Jerk with a superlong string")
-				}
-				logger.Infof("Connection #%d from: %s, %s, %s", s.count+1, sshConn.RemoteAddr(), sshConn.User(), version)
-
-				go ssh.DiscardRequests(requests)
-
-				client := NewClient(s, sshConn)
-				go client.handleChannels(channels)
-			}()
+			go s.handleConn(conn)
 		}
 	}()
 
@@ -259,11 +1361,152 @@ func (s *Server) Start(laddr string) error {
 		socket.Close()
 	}()
 
+	go func() {
+		ticker := time.NewTicker(IDLE_CHECK_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.checkIdle()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	if s.JanitorInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(s.JanitorInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					s.sweep()
+				case <-s.done:
+					return
+				}
+			}
+		}()
+	}
+
 	return nil
 }
 
+// handleConn runs the SSH handshake on a new connection and, unless the
+// client is turned away, lets it open its session.
+func (s *Server) handleConn(conn net.Conn) {
+	if s.Throttle.IsBlocked(conn.RemoteAddr()) {
+		logger.Debugf("Dropping connection from locked out %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	s.emit(Event{Type: EventConnected, Time: s.Clock(), RemoteAddr: conn.RemoteAddr().String()})
+
+	// From a standard TCP connection to an encrypted SSH connection. The
+	// deadline only covers the handshake, and is lifted once it's done.
+	if s.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, s.sshConfig)
+	if err != nil {
+		conn.Close()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			logger.Infof("Handshake with %s timed out after %s", conn.RemoteAddr(), s.HandshakeTimeout)
+		} else {
+			logger.Errorf("Failed to handshake: %v", err)
+		}
+		// Only failed authentication counts toward a lockout. Scans, health
+		// checks, and slow or broken handshakes fail before that, and
+		// counting them would lock out load balancers and shared NATs.
+		if _, ok := err.(*ssh.ServerAuthError); ok {
+			if lockout := s.Throttle.Fail(conn.RemoteAddr()); lockout > 0 {
+				logger.Warningf("Locking out %s for %s after repeated failed logins", conn.RemoteAddr(), lockout)
+			}
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.Throttle.Reset(conn.RemoteAddr())
+
+	go ssh.DiscardRequests(requests)
+
+	if notice, banned := sshConn.Permissions.Extensions["banned"]; banned {
+		logger.Infof("Rejecting banned %s from %s", sshConn.Permissions.Extensions["fingerprint"], sshConn.RemoteAddr())
+		rejectSession(sshConn, channels, notice)
+		return
+	}
+	op := s.isOpKey(sshConn.Permissions.Extensions["fingerprint"])
+	if notice := s.refusal(op); notice != "" {
+		logger.Infof("Rejecting %s from %s: %s", sshConn.User(), sshConn.RemoteAddr(), notice)
+		rejectSession(sshConn, channels, notice)
+		return
+	}
+
+	client := NewClient(s, sshClientConn{ServerConn: sshConn})
+	s.emit(newEvent(EventAuthenticated, client))
+	version := truncate(client.Version(), s.VersionLength)
+	logger.Infof("Connection #%d from: %s, %s, %s", s.count+1, sshConn.RemoteAddr(), sshConn.User(), version)
+	go client.handleChannels(channels)
+}
+
+// sweep forgets expired bans, silences, mentions, and login failures. Each
+// is under its own lock, and none is held while taking another.
+func (s *Server) sweep() {
+	now := s.Clock()
+	s.lock.Lock()
+	for fingerprint, ban := range s.banned {
+		if ban.Until != nil && ban.Until.Before(now) {
+			delete(s.banned, fingerprint)
+		}
+	}
+	for identity, until := range s.silenced {
+		if !until.After(now) {
+			delete(s.silenced, identity)
+		}
+	}
+	s.lock.Unlock()
+
+	s.mentions.Prune()
+	s.Throttle.Prune()
+}
+
+// checkIdle marks clients that have been idle for AwayAfter as away, and
+// disconnects those idle for IdleTimeout.
+func (s *Server) checkIdle() {
+	for _, client := range s.clients.All() {
+		idle := client.Idle()
+		switch {
+		case s.IdleTimeout > 0 && idle >= s.IdleTimeout:
+			logger.Infof("Disconnecting %s after being idle for %s", client.Name, idle.Round(time.Second))
+			client.SysWrite("%s", s.Text("idle_timeout", idle.Round(time.Second)))
+			client.Conn.Close()
+		case s.AwayAfter > 0 && idle >= s.AwayAfter && client.goIdle():
+			client.tell("idle_away")
+		}
+	}
+}
+
+func (s *Server) setListening(listening bool) {
+	s.lock.Lock()
+	s.listening = listening
+	s.lock.Unlock()
+}
+
+// Ready reports whether the server is accepting SSH connections: it's been
+// started, the listener hasn't failed, and it isn't stopping or draining.
+func (s *Server) Ready() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.listening && !s.draining
+}
+
 func (s *Server) Stop() {
-	for _, client := range s.clients {
+	for _, client := range s.clients.All() {
 		client.Conn.Close()
 	}
 
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Telnet protocol bytes.
+const (
+	TELNET_IAC  = 255
+	TELNET_DONT = 254
+	TELNET_DO   = 253
+	TELNET_WONT = 252
+	TELNET_WILL = 251
+	TELNET_SB   = 250
+	TELNET_NOP  = 241
+	TELNET_SE   = 240
+
+	TELNET_ECHO = 1
+	TELNET_SGA  = 3
+)
+
+// telnetHello asks the client to leave echoing to the server and send each
+// key as it's typed, which is what the terminal expects.
+var telnetHello = []byte{TELNET_IAC, TELNET_WILL, TELNET_ECHO, TELNET_IAC, TELNET_WILL, TELNET_SGA}
+
+// StartTelnet listens for plaintext connections on laddr and lets them into
+// the room as guests. Nothing on this port is encrypted or authenticated.
+func (s *Server) StartTelnet(laddr string) error {
+	socket, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return err
+	}
+
+	logger.Warningf("Listening for telnet on %s. Telnet is UNENCRYPTED and UNAUTHENTICATED: "+
+		"anyone on the network path can read and forge these connections, and guests can't be banned by key.", laddr)
+
+	go func() {
+		for {
+			conn, err := socket.Accept()
+			if err != nil {
+				logger.Errorf("Failed to accept telnet connection, aborting loop: %v", err)
+				return
+			}
+			go s.handleTelnet(conn)
+		}
+	}()
+
+	go func() {
+		<-s.done
+		socket.Close()
+	}()
+
+	return nil
+}
+
+// handleTelnet runs a guest's session over a plaintext connection. Guests get
+// a numbered name they can't change, have no fingerprint, and can't be ops.
+func (s *Server) handleTelnet(conn net.Conn) {
+	// Guests have nothing to get wrong, but an address locked out for
+	// failed SSH logins is kept out here too.
+	if s.Throttle.IsBlocked(conn.RemoteAddr()) {
+		logger.Debugf("Dropping telnet connection from locked out %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if notice := s.refusal(false); notice != "" {
+		fmt.Fprintf(conn, "-> %s\r\n", notice)
+		conn.Close()
+		return
+	}
+	name := s.nextGuestName()
+	logger.Infof("Telnet connection from: %s, %s", conn.RemoteAddr(), name)
+
+	tc := &telnetConn{Conn: conn, user: name, closed: make(chan struct{})}
+	client := NewClient(s, tc)
+	client.guest = true
+	s.emit(newEvent(EventConnected, client))
+
+	channel := &telnetChannel{conn: tc}
+	if _, err := conn.Write(telnetHello); err != nil {
+		tc.Close()
+		return
+	}
+	client.term = terminal.NewTerminal(channel, client.prompt())
+	client.handleShell(channel)
+}
+
+// nextGuestName returns a name for the next guest. It's guest_N rather than
+// guest-N, as names may only have letters, digits, and underscores, and a
+// dash would be stripped from it.
+func (s *Server) nextGuestName() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.guests++
+	return fmt.Sprintf("guest_%d", s.guests)
+}
+
+// telnetConn is the Conn for a plaintext connection, which has no key.
+type telnetConn struct {
+	net.Conn
+	user   string
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *telnetConn) User() string          { return c.user }
+func (c *telnetConn) Fingerprint() string   { return "" }
+func (c *telnetConn) ClientVersion() []byte { return []byte("telnet") }
+func (c *telnetConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.closed) })
+	return err
+}
+func (c *telnetConn) Wait() error {
+	<-c.closed
+	return nil
+}
+
+// Keepalive sends a telnet no-op, which clients don't show.
+func (c *telnetConn) Keepalive() error {
+	_, err := c.Conn.Write([]byte{TELNET_IAC, TELNET_NOP})
+	return err
+}
+
+// telnetChannel is what the terminal of a telnet session reads from and
+// writes to. It strips telnet commands from the input.
+type telnetChannel struct {
+	conn  *telnetConn
+	state int
+}
+
+// Where a telnetChannel is in the input, for commands split across reads.
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSub
+	telnetSubCommand
+)
+
+func (c *telnetChannel) Read(p []byte) (int, error) {
+	for {
+		n, err := c.conn.Read(p)
+		n = c.filter(p[:n])
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// filter removes telnet commands from b in place and returns how many bytes
+// of data are left.
+func (c *telnetChannel) filter(b []byte) int {
+	n := 0
+	for _, ch := range b {
+		switch c.state {
+		case telnetData:
+			if ch == TELNET_IAC {
+				c.state = telnetCommand
+				continue
+			}
+			b[n] = ch
+			n++
+		case telnetCommand:
+			switch {
+			case ch == TELNET_IAC:
+				// An escaped 255 is data.
+				b[n] = ch
+				n++
+				c.state = telnetData
+			case ch == TELNET_SB:
+				c.state = telnetSub
+			case ch >= TELNET_WILL && ch <= TELNET_DONT:
+				c.state = telnetOption
+			default:
+				c.state = telnetData
+			}
+		case telnetOption:
+			c.state = telnetData
+		case telnetSub:
+			if ch == TELNET_IAC {
+				c.state = telnetSubCommand
+			}
+		case telnetSubCommand:
+			if ch == TELNET_SE {
+				c.state = telnetData
+			} else {
+				c.state = telnetSub
+			}
+		}
+	}
+	return n
+}
+
+func (c *telnetChannel) Write(data []byte) (int, error) { return c.conn.Write(data) }
+func (c *telnetChannel) Close() error                   { return c.conn.Close() }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTelnetFilter(t *testing.T) {
+	c := &telnetChannel{}
+	input := []byte("he\xff\xfd\x01l\xff\xfa\x1f\x00\x50\xff\xf0lo\xff\xff\xff")
+	// Split the input to check that commands spanning reads are removed.
+	got := ""
+	for _, chunk := range [][]byte{input[:3], input[3:8], input[8:]} {
+		got += string(chunk[:c.filter(chunk)])
+	}
+	if got != "hello\xff" {
+		t.Errorf("Got %q, expected %q", got, "hello\xff")
+	}
+}
+
+func TestTelnetGuest(t *testing.T) {
+	server := newTestServer(t)
+	local, remote := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		server.handleTelnet(remote)
+		close(done)
+	}()
+	go io.Copy(ioutil.Discard, local)
+
+	local.Write([]byte("/nick admin\r\nhello\r\n"))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(server.history.Search("guest_1: hello")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(server.history.Search("guest_1: hello")) != 1 {
+		t.Errorf("Guest message wasn't broadcast: %q", server.history.Get(10))
+	}
+
+	guest := server.Who("guest_1")
+	if guest == nil {
+		t.Fatal("Guest isn't connected.")
+	}
+	server.Op("")
+	if server.IsOp(guest) {
+		t.Errorf("Guest can be op.")
+	}
+	if guest.Fingerprint() != "" {
+		t.Errorf("Guest has fingerprint %q", guest.Fingerprint())
+	}
+
+	local.Close()
+	<-done
+	deadline = time.Now().Add(2 * time.Second)
+	for server.Who("guest_1") != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.Who("guest_1") != nil {
+		t.Errorf("Guest wasn't removed after disconnecting.")
+	}
+}
+
+func TestTelnetLockedOut(t *testing.T) {
+	server := newTestServer(t)
+	server.Throttle = NewLoginThrottle(1, time.Minute)
+	local, remote := net.Pipe()
+	server.Throttle.Fail(remote.RemoteAddr())
+
+	go server.handleTelnet(remote)
+	if data, err := ioutil.ReadAll(local); err != nil || len(data) != 0 {
+		t.Errorf("Locked out address got %q, %v", data, err)
+	}
+	if server.Len() != 0 {
+		t.Errorf("Locked out address joined.")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import "hash/fnv"
+
+const RESET = "\033[0m"
+
+// Theme is a palette used to color output for a client.
+type Theme struct {
+	Name      string
+	System    string   // Escape for system messages
+	Highlight string   // Escape for highlighted text
+	Names     []string // Escapes that names are colored with
+}
+
+var DefaultTheme = &Theme{
+	Name:      "default",
+	System:    "\033[90m",
+	Highlight: "\033[1m",
+	Names:     []string{"\033[31m", "\033[32m", "\033[33m", "\033[34m", "\033[35m", "\033[36m", "\033[91m", "\033[92m", "\033[93m", "\033[94m", "\033[95m", "\033[96m"},
+}
+
+var SolarizedTheme = &Theme{
+	Name:      "solarized",
+	System:    "\033[38;5;240m",
+	Highlight: "\033[1;38;5;166m",
+	Names:     []string{"\033[38;5;136m", "\033[38;5;166m", "\033[38;5;160m", "\033[38;5;125m", "\033[38;5;61m", "\033[38;5;33m", "\033[38;5;37m", "\033[38;5;64m"},
+}
+
+// MonochromeTheme disables color entirely.
+var MonochromeTheme = &Theme{
+	Name: "monochrome",
+}
+
+var Themes = []*Theme{DefaultTheme, SolarizedTheme, MonochromeTheme}
+
+// FindTheme returns the theme with the given name, or nil.
+func FindTheme(name string) *Theme {
+	for _, theme := range Themes {
+		if theme.Name == name {
+			return theme
+		}
+	}
+	return nil
+}
+
+// ThemeNames returns the names of all themes.
+func ThemeNames() []string {
+	r := make([]string, len(Themes))
+	for i, theme := range Themes {
+		r[i] = theme.Name
+	}
+	return r
+}
+
+func colorize(escape string, s string) string {
+	if escape == "" {
+		return s
+	}
+	return escape + s + RESET
+}
+
+// ColorName colors name, picking the color deterministically from key so
+// that the same user always gets the same color.
+func (t *Theme) ColorName(name string, key string) string {
+	if len(t.Names) == 0 {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return colorize(t.Names[h.Sum32()%uint32(len(t.Names))], name)
+}
+
+func (t *Theme) ColorSystem(s string) string {
+	return colorize(t.System, s)
+}
+
+func (t *Theme) ColorHighlight(s string) string {
+	return colorize(t.Highlight, s)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// How long a source's failures are remembered once it's no longer locked out.
+const LOGIN_FAILURE_WINDOW = 10 * time.Minute
+
+// The longest a source can be locked out for, however often it fails.
+const MAX_LOGIN_LOCKOUT = time.Hour
+
+type loginFailures struct {
+	count        int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+// LoginThrottle tracks failed logins per source IP and locks out sources
+// that keep failing. The lockout doubles with each further failure.
+type LoginThrottle struct {
+	// Attempts is how many failures are allowed before locking out. Zero
+	// disables throttling.
+	Attempts int
+	// Lockout is how long the first lockout lasts.
+	Lockout time.Duration
+	// Clock tells the time failures and lockouts are counted by.
+	Clock Clock
+
+	lock     sync.Mutex
+	failures map[string]*loginFailures // ip lookup
+}
+
+func NewLoginThrottle(attempts int, lockout time.Duration) *LoginThrottle {
+	return &LoginThrottle{
+		Attempts: attempts,
+		Lockout:  lockout,
+		failures: map[string]*loginFailures{},
+	}
+}
+
+// IsBlocked reports whether logins from addr are currently locked out.
+func (t *LoginThrottle) IsBlocked(addr net.Addr) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	f, ok := t.failures[hostOf(addr)]
+	return ok && f.blockedUntil.After(t.Clock.Now())
+}
+
+// Fail records a failed login from addr and returns how long it's now locked
+// out for, which is zero while it still has attempts left.
+func (t *LoginThrottle) Fail(addr net.Addr) time.Duration {
+	if t.Attempts <= 0 {
+		return 0
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.Clock.Now()
+	ip := hostOf(addr)
+	f, ok := t.failures[ip]
+	if !ok {
+		t.prune(now)
+		f = &loginFailures{}
+		t.failures[ip] = f
+	}
+	f.count++
+	f.last = now
+
+	if f.count < t.Attempts {
+		return 0
+	}
+
+	lockout := t.Lockout
+	for i := t.Attempts; i < f.count && lockout < MAX_LOGIN_LOCKOUT; i++ {
+		lockout *= 2
+	}
+	if lockout > MAX_LOGIN_LOCKOUT {
+		lockout = MAX_LOGIN_LOCKOUT
+	}
+	f.blockedUntil = now.Add(lockout)
+	return lockout
+}
+
+// Reset forgets the failures from addr after a successful login.
+func (t *LoginThrottle) Reset(addr net.Addr) {
+	t.lock.Lock()
+	delete(t.failures, hostOf(addr))
+	t.lock.Unlock()
+}
+
+// Prune forgets sources that are no longer locked out and haven't failed
+// recently.
+func (t *LoginThrottle) Prune() {
+	t.lock.Lock()
+	t.prune(t.Clock.Now())
+	t.lock.Unlock()
+}
+
+// prune drops sources that are no longer locked out and haven't failed
+// recently. Assumes caller holds lock.
+func (t *LoginThrottle) prune(now time.Time) {
+	for ip, f := range t.failures {
+		if f.blockedUntil.Before(now) && now.Sub(f.last) > LOGIN_FAILURE_WINDOW {
+			delete(t.failures, ip)
+		}
+	}
+}
+
+// hostOf returns the IP part of addr, so that failures aren't tracked per port.
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
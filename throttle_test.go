@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	throttle := NewLoginThrottle(3, time.Minute)
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	otherPort := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4321}
+
+	if lockout := throttle.Fail(addr); lockout != 0 {
+		t.Errorf("Locked out after a single failure: %v", lockout)
+	}
+	throttle.Fail(addr)
+	if throttle.IsBlocked(addr) {
+		t.Errorf("Blocked before reaching the attempt limit.")
+	}
+
+	if lockout := throttle.Fail(otherPort); lockout != time.Minute {
+		t.Errorf("Wrong lockout: %v", lockout)
+	}
+	if !throttle.IsBlocked(addr) {
+		t.Errorf("Not blocked after reaching the attempt limit.")
+	}
+	if lockout := throttle.Fail(addr); lockout != 2*time.Minute {
+		t.Errorf("Lockout didn't increase: %v", lockout)
+	}
+
+	throttle.Reset(addr)
+	if throttle.IsBlocked(addr) {
+		t.Errorf("Still blocked after reset.")
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The largest WebSocket message accepted from a client.
+const MAX_WS_MESSAGE = 4096
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+var errWSMessageTooLarge = errors.New("websocket message too large")
+
+// wsMessage is the JSON in each WebSocket text frame, both ways. Frames from
+// the client are handled like a typed line, chat or command, and each line
+// for the client is sent as a frame of its own, without colors.
+type wsMessage struct {
+	Text string `json:"text"`
+}
+
+// StartWebSocket accepts WebSocket connections on laddr. If WSToken is set,
+// clients must pass it as the token query parameter and may pick a name with
+// the name parameter. Otherwise anyone may join as a guest, as over telnet.
+func (s *Server) StartWebSocket(laddr string) error {
+	socket, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return err
+	}
+
+	if s.WSToken == "" {
+		logger.Warningf("Listening for WebSockets on %s, open to anonymous guests.", laddr)
+	} else {
+		logger.Infof("Listening for WebSockets on %s", laddr)
+	}
+
+	go func() {
+		err := http.Serve(socket, http.HandlerFunc(s.handleWebSocket))
+		logger.Errorf("Stopped serving WebSockets: %v", err)
+	}()
+
+	go func() {
+		<-s.done
+		socket.Close()
+	}()
+
+	return nil
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !s.allowOrigin(r) {
+		logger.Debugf("Refusing WebSocket from %s for origin %s", r.RemoteAddr, r.Header.Get("Origin"))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	guest := true
+	name := ""
+	if s.WSToken != "" {
+		// Wrong tokens count toward a lockout like failed SSH logins, so
+		// the token can't be guessed at HTTP speed.
+		addr := httpAddr(r.RemoteAddr)
+		if s.Throttle.IsBlocked(addr) {
+			http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+			return
+		}
+		token := r.URL.Query().Get("token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.WSToken)) != 1 {
+			if lockout := s.Throttle.Fail(addr); lockout > 0 {
+				logger.Warningf("Locking out %s for %s after repeated wrong WebSocket tokens", r.RemoteAddr, lockout)
+			}
+			http.Error(w, "Invalid token", http.StatusForbidden)
+			return
+		}
+		s.Throttle.Reset(addr)
+		guest = false
+		name = r.URL.Query().Get("name")
+	}
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		logger.Debugf("Failed WebSocket upgrade from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	if notice := s.refusal(false); notice != "" {
+		ws.Write([]byte("-> " + notice + "\r\n"))
+		ws.Close()
+		return
+	}
+	if guest || name == "" {
+		name = s.nextGuestName()
+	}
+
+	logger.Infof("WebSocket connection from: %s, %s", ws.RemoteAddr(), name)
+
+	conn := &wsServerConn{wsConn: ws, user: name}
+	client := NewClient(s, conn)
+	client.guest = guest
+	s.emit(newEvent(EventConnected, client))
+	if !guest {
+		s.emit(newEvent(EventAuthenticated, client))
+	}
+	client.term = ws
+	client.handleShell(ws)
+}
+
+// allowOrigin reports whether a WebSocket may be opened for r. Browsers send
+// the page's origin, and only the server's own and WSOrigins are let in, so
+// that other sites can't open sessions from their visitors' browsers. Other
+// clients send none.
+func (s *Server) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range s.WSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// httpAddr is the remote address of an HTTP request, for the login throttle.
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
+
+// upgradeWebSocket completes the WebSocket handshake for r and takes over its
+// connection.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "Expected a WebSocket", http.StatusBadRequest)
+		return nil, errors.New("not a websocket request")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Can't upgrade", http.StatusInternalServerError)
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(hash[:])
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept)
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return newWSConn(conn, rw.Reader), nil
+}
+
+// wsConn is a server side WebSocket connection. It's also the client's
+// Terminal, reading a line per message and writing a message per line.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	writeLock sync.Mutex
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func newWSConn(conn net.Conn, r *bufio.Reader) *wsConn {
+	return &wsConn{Conn: conn, r: r, closed: make(chan struct{})}
+}
+
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.closed) })
+	return err
+}
+
+// ReadLine returns the text of the next message from the client.
+func (c *wsConn) ReadLine() (string, error) {
+	for {
+		opcode, payload, err := c.readMessage()
+		if err != nil {
+			return "", err
+		}
+		if opcode != wsText {
+			continue
+		}
+		msg := wsMessage{}
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			logger.Debugf("Ignoring invalid WebSocket message from %s: %v", c.RemoteAddr(), err)
+			continue
+		}
+		return strings.TrimRight(msg.Text, "\r\n"), nil
+	}
+}
+
+// Write sends each complete line in p as a message of its own.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\r\n"), "\r\n") {
+		data, err := json.Marshal(wsMessage{Text: RE_ESCAPE.ReplaceAllString(line, "")})
+		if err != nil {
+			return 0, err
+		}
+		if err := c.writeFrame(wsText, data); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) SetPrompt(prompt string)             {}
+func (c *wsConn) SetSize(width int, height int) error { return nil }
+
+// readMessage reads frames until it has a whole data message, answering
+// pings and closes along the way.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	message := []byte{}
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeFrame(wsClose, nil)
+			return 0, nil, io.EOF
+		case wsContinuation:
+		default:
+			opcode = op
+		}
+
+		if len(message)+len(payload) > MAX_WS_MESSAGE {
+			return 0, nil, errWSMessageTooLarge
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(c.r, header); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(c.r, ext); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(c.r, ext); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > MAX_WS_MESSAGE {
+		err = errWSMessageTooLarge
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(n))
+		header = append(append(header, 127), ext...)
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if _, err := c.Conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.Conn.Write(payload)
+	return err
+}
+
+// wsServerConn is the Conn for a WebSocket, which has no key.
+type wsServerConn struct {
+	*wsConn
+	user string
+}
+
+func (c *wsServerConn) User() string          { return c.user }
+func (c *wsServerConn) Fingerprint() string   { return "" }
+func (c *wsServerConn) ClientVersion() []byte { return []byte("websocket") }
+func (c *wsServerConn) Wait() error {
+	<-c.closed
+	return nil
+}
+
+// Keepalive sends a ping, which browsers answer without telling the page.
+func (c *wsServerConn) Keepalive() error {
+	return c.writeFrame(wsPing, nil)
+}
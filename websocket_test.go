@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialWebSocket opens a WebSocket to the test server at url with query.
+func dialWebSocket(t *testing.T, url string, query string) (net.Conn, *bufio.Reader, string) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET /?%s HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", query)
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, resp.Status + " " + resp.Header.Get("Sec-WebSocket-Accept")
+}
+
+// writeClientFrame writes a masked text frame, as clients must.
+func writeClientFrame(conn net.Conn, text string) {
+	payload := []byte(text)
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | wsText, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	conn.Write(frame)
+}
+
+func TestWebSocketGuest(t *testing.T) {
+	server := newTestServer(t)
+	ts := httptest.NewServer(http.HandlerFunc(server.handleWebSocket))
+	defer ts.Close()
+
+	conn, r, status := dialWebSocket(t, ts.URL, "")
+	defer conn.Close()
+	if status != "101 Switching Protocols s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Got handshake %q", status)
+	}
+
+	ws := newWSConn(conn, r)
+	line, err := ws.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(line, "\x1b") {
+		t.Errorf("Line has escapes: %q", line)
+	}
+
+	writeClientFrame(conn, `{"text": "hello"}`)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(server.history.Search("guest_1: hello")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(server.history.Search("guest_1: hello")) != 1 {
+		t.Errorf("WebSocket message wasn't broadcast: %q", server.history.Get(10))
+	}
+}
+
+func TestWebSocketToken(t *testing.T) {
+	server := newTestServer(t)
+	server.WSToken = "secret"
+	ts := httptest.NewServer(http.HandlerFunc(server.handleWebSocket))
+	defer ts.Close()
+
+	conn, _, status := dialWebSocket(t, ts.URL, "token=wrong")
+	conn.Close()
+	if !strings.HasPrefix(status, "403") {
+		t.Errorf("Got %q with the wrong token", status)
+	}
+
+	conn, r, status := dialWebSocket(t, ts.URL, "token=secret&name=alice")
+	defer conn.Close()
+	if !strings.HasPrefix(status, "101") {
+		t.Fatalf("Got %q with the right token", status)
+	}
+	ws := newWSConn(conn, r)
+	for {
+		line, err := ws.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(line, "Welcome") {
+			break
+		}
+	}
+	if server.Who("alice") == nil {
+		t.Errorf("Client with a token didn't get the name they asked for.")
+	}
+
+	// Wrong tokens lock the address out, even from the right token.
+	server.Throttle = NewLoginThrottle(2, time.Minute)
+	for _, token := range []string{"wrong", "wrong", "secret"} {
+		conn, _, status = dialWebSocket(t, ts.URL, "token="+token)
+		conn.Close()
+	}
+	if !strings.HasPrefix(status, "429") {
+		t.Errorf("Got %q after repeated wrong tokens", status)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	server := newTestServer(t)
+	tests := []struct {
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{"", nil, true},
+		{"http://chat.example.com", nil, true},
+		{"https://evil.example", nil, false},
+		{"https://evil.example", []string{"https://other.example"}, false},
+		{"https://app.example", []string{"https://app.example"}, true},
+		{"https://evil.example", []string{"*"}, true},
+	}
+	for _, test := range tests {
+		server.WSOrigins = test.allowed
+		r := httptest.NewRequest("GET", "http://chat.example.com/", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if got := server.allowOrigin(r); got != test.want {
+			t.Errorf("allowOrigin(%q) with %q = %v, expected %v", test.origin, test.allowed, got, test.want)
+		}
+	}
+}